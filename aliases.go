@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// addressAliases maps alias names to lists of addresses, as defined in
+// sendemail.aliasesFile. Addresses may refer to other aliases.
+type addressAliases map[string][]string
+
+// loadAddressAliases reads the git-send-email aliases files.
+func loadAddressAliases(identity string) (addressAliases, error) {
+	filenames, err := getAllSendEmailConfig(identity, "aliasesFile")
+	if err != nil {
+		return nil, err
+	} else if len(filenames) == 0 {
+		return nil, nil
+	}
+
+	fileType, err := getSendEmailConfig(identity, "aliasFileType")
+	if err != nil {
+		return nil, err
+	}
+	var parse func(aliases addressAliases, sc *bufio.Scanner)
+	switch fileType {
+	case "mutt":
+		parse = parseMuttAliases
+	case "mailrc":
+		parse = parseMailrcAliases
+	case "pine":
+		parse = parsePineAliases
+	case "elm":
+		parse = parseElmAliases
+	case "gnus":
+		parse = parseGnusAliases
+	case "sendmail":
+		parse = parseSendmailAliases
+	case "":
+		return nil, fmt.Errorf("sendemail.aliasesFile is set but sendemail.aliasFileType is missing")
+	default:
+		return nil, fmt.Errorf("invalid sendemail.aliasFileType %q", fileType)
+	}
+
+	aliases := make(addressAliases)
+	for _, filename := range filenames {
+		// Expand "~/" like git-send-email does
+		if strings.HasPrefix(filename, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				filename = home + filename[1:]
+			}
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open aliases file: %v", err)
+		}
+		sc := bufio.NewScanner(f)
+		parse(aliases, sc)
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read aliases file %q: %v", filename, err)
+		}
+	}
+	return aliases, nil
+}
+
+// splitAliasAddresses splits a comma-separated list of addresses, ignoring
+// commas inside quotes or angle brackets.
+func splitAliasAddresses(s string) []string {
+	var (
+		l        []string
+		start    int
+		quoted   bool
+		brackets int
+	)
+	for i, ch := range s {
+		switch {
+		case ch == '"':
+			quoted = !quoted
+		case ch == '<' && !quoted:
+			brackets++
+		case ch == '>' && !quoted && brackets > 0:
+			brackets--
+		case ch == ',' && !quoted && brackets == 0:
+			l = append(l, s[start:i])
+			start = i + 1
+		}
+	}
+	l = append(l, s[start:])
+
+	var addrs []string
+	for _, addr := range l {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+var muttAliasRegexp = regexp.MustCompile(`^\s*alias\s+(?:-group\s+\S+\s+)*(\S+)\s+(.*)$`)
+
+func parseMuttAliases(aliases addressAliases, sc *bufio.Scanner) {
+	for sc.Scan() {
+		m := muttAliasRegexp.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		// Strip trailing comments
+		addrs := m[2]
+		if i := strings.Index(addrs, " #"); i >= 0 {
+			addrs = addrs[:i]
+		}
+		aliases[m[1]] = splitAliasAddresses(addrs)
+	}
+}
+
+var mailrcAliasRegexp = regexp.MustCompile(`^\s*alias\s+(\S+)\s+(.*?)\s*$`)
+
+func parseMailrcAliases(aliases addressAliases, sc *bufio.Scanner) {
+	for sc.Scan() {
+		m := mailrcAliasRegexp.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		aliases[m[1]] = splitMailrcAddresses(m[2])
+	}
+}
+
+// splitMailrcAddresses splits a list of whitespace-separated addresses. Double
+// quotes group words into a single address, e.g. "John Doe <john@example.org>".
+func splitMailrcAddresses(s string) []string {
+	var (
+		addrs  []string
+		sb     strings.Builder
+		quoted bool
+	)
+	flush := func() {
+		if sb.Len() > 0 {
+			addrs = append(addrs, sb.String())
+			sb.Reset()
+		}
+	}
+	for _, ch := range s {
+		switch {
+		case ch == '"':
+			quoted = !quoted
+		case (ch == ' ' || ch == '\t') && !quoted:
+			flush()
+		default:
+			sb.WriteRune(ch)
+		}
+	}
+	flush()
+	return addrs
+}
+
+func parsePineAliases(aliases addressAliases, sc *bufio.Scanner) {
+	var lines []string
+	for sc.Scan() {
+		l := sc.Text()
+		// Lines starting with a space are continuations
+		if strings.HasPrefix(l, " ") && len(lines) > 0 {
+			lines[len(lines)-1] += strings.TrimLeft(l, " ")
+		} else {
+			lines = append(lines, l)
+		}
+	}
+
+	for _, l := range lines {
+		fields := strings.Split(l, "\t")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		addrs := strings.TrimSuffix(strings.TrimPrefix(fields[2], "("), ")")
+		aliases[fields[0]] = splitAliasAddresses(addrs)
+	}
+}
+
+var elmAliasRegexp = regexp.MustCompile(`^(\S+)\s+=\s+[^=]+=\s(\S+)`)
+
+func parseElmAliases(aliases addressAliases, sc *bufio.Scanner) {
+	for sc.Scan() {
+		m := elmAliasRegexp.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		aliases[m[1]] = splitAliasAddresses(m[2])
+	}
+}
+
+var gnusAliasRegexp = regexp.MustCompile(`\(define-mail-alias\s+"(\S+?)"\s+"(\S+?)"\)`)
+
+func parseGnusAliases(aliases addressAliases, sc *bufio.Scanner) {
+	for sc.Scan() {
+		m := gnusAliasRegexp.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		aliases[m[1]] = []string{m[2]}
+	}
+}
+
+func parseSendmailAliases(aliases addressAliases, sc *bufio.Scanner) {
+	var lines []string
+	for sc.Scan() {
+		l := sc.Text()
+		if strings.HasPrefix(strings.TrimSpace(l), "#") || strings.TrimSpace(l) == "" {
+			continue
+		}
+		// Lines starting with whitespace are continuations
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += " " + strings.TrimSpace(l)
+		} else {
+			lines = append(lines, l)
+		}
+	}
+
+	for _, l := range lines {
+		name, addrs, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		aliases[strings.TrimSpace(name)] = splitAliasAddresses(addrs)
+	}
+}
+
+// expand replaces the aliases in a comma-separated address list with their
+// addresses. Entries which aren't aliases are left as-is.
+func (aliases addressAliases) expand(s string) string {
+	if len(aliases) == 0 {
+		return s
+	}
+	var l []string
+	for _, entry := range splitAliasAddresses(s) {
+		l = append(l, aliases.expandEntry(entry, make(map[string]bool))...)
+	}
+	return strings.Join(l, ", ")
+}
+
+func (aliases addressAliases) expandEntry(entry string, seen map[string]bool) []string {
+	addrs, ok := aliases[entry]
+	if !ok || seen[entry] {
+		return []string{entry}
+	}
+	seen[entry] = true
+
+	var l []string
+	for _, addr := range addrs {
+		l = append(l, aliases.expandEntry(addr, seen)...)
+	}
+	return l
+}
+
+// Maximum number of commits scanned for address suggestions
+const addressSuggestionsMaxCommits = 1000
+
+// loadGitLogAddresses collects the addresses of authors, committers and
+// trailers in the recent history, most frequent first.
+func loadGitLogAddresses(ctx context.Context) ([]*mail.Address, error) {
+	cmd := exec.CommandContext(ctx, "git", "log", fmt.Sprintf("--max-count=%v", addressSuggestionsMaxCommits), "--pretty=format:%aN <%aE>%x00%cN <%cE>%x00%B%x1e")
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load git log: %v", err)
+	}
+
+	var (
+		addrs []*mail.Address
+		count = make(map[string]int)
+	)
+	add := func(s string) {
+		addr, err := mail.ParseAddress(s)
+		if err != nil {
+			return
+		}
+		k := strings.ToLower(addr.Address)
+		if count[k] == 0 {
+			addrs = append(addrs, addr)
+		}
+		count[k]++
+	}
+	for _, rec := range strings.Split(string(b), "\x1e") {
+		fields := strings.SplitN(strings.TrimPrefix(rec, "\n"), "\x00", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		add(fields[0])
+		add(fields[1])
+		for _, t := range parseTrailers(fields[2]) {
+			add(t.Value)
+		}
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return count[strings.ToLower(addrs[i].Address)] > count[strings.ToLower(addrs[j].Address)]
+	})
+	return addrs, nil
+}
+
+// addressSuggestions returns completions for the last entry of a
+// comma-separated address list.
+func addressSuggestions(value string, aliases addressAliases, addrs []*mail.Address) []string {
+	prefix, entry := "", value
+	if i := strings.LastIndexByte(value, ','); i >= 0 {
+		prefix, entry = value[:i+1]+" ", strings.TrimLeft(value[i+1:], " ")
+	}
+	entry = strings.ToLower(entry)
+	if entry == "" {
+		return nil
+	}
+
+	var candidates []string
+	for name := range aliases {
+		candidates = append(candidates, name)
+	}
+	sort.Strings(candidates)
+	for _, addr := range addrs {
+		candidates = append(candidates, formatAddressList([]*mail.Address{addr}), addr.Address)
+	}
+
+	var suggestions []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), entry) {
+			suggestions = append(suggestions, prefix+candidate)
+		}
+	}
+	return suggestions
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMailrcAliases(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  addressAliases
+	}{
+		{
+			name:  "single",
+			input: "alias joe joe@example.org\n",
+			want:  addressAliases{"joe": {"joe@example.org"}},
+		},
+		{
+			name:  "multiple",
+			input: "alias team joe@example.org  jane@example.org\t\n",
+			want:  addressAliases{"team": {"joe@example.org", "jane@example.org"}},
+		},
+		{
+			name:  "quoted",
+			input: `alias joe "Joe Doe <joe@example.org>" jane@example.org` + "\n",
+			want:  addressAliases{"joe": {"Joe Doe <joe@example.org>", "jane@example.org"}},
+		},
+		{
+			name:  "alias reference",
+			input: "alias team joe jane@example.org\n",
+			want:  addressAliases{"team": {"joe", "jane@example.org"}},
+		},
+		{
+			name:  "other lines",
+			input: "# comment\nset ask\n  alias joe joe@example.org\n",
+			want:  addressAliases{"joe": {"joe@example.org"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			aliases := make(addressAliases)
+			parseMailrcAliases(aliases, bufio.NewScanner(strings.NewReader(tc.input)))
+			if !reflect.DeepEqual(aliases, tc.want) {
+				t.Errorf("parseMailrcAliases() = %q, want %q", aliases, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// getB4Config reads a b4 setting. Like b4 does, the project's .b4-config file
+// is overridden by the b4 section of the Git config.
+func getB4Config(key string) (string, error) {
+	k := "b4." + key
+	if v, ok, err := lookupGitConfig(k); err != nil || ok {
+		return v, err
+	}
+
+	toplevelDir, err := getGitToplevelDir()
+	if err != nil {
+		return "", err
+	}
+	b4ConfigPath := filepath.Join(toplevelDir, ".b4-config")
+	if _, err := os.Stat(b4ConfigPath); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("git", "config", "--file="+b4ConfigPath, "--default=", k)
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get b4 config %q: %v", k, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// b4Tracking is the data b4 prep keeps about a series: its change-id, the
+// next version to send, and the Message-IDs of the versions sent. It's stored
+// after the cover letter in the cover letter commit, or in the branch config
+// when the cover letter is in the branch description.
+type b4Tracking struct {
+	Branch string
+	Commit *logCommit // cover letter commit, nil if stored in the branch config
+
+	// Decoded JSON, kept as-is to preserve the fields unknown to pyonji
+	data map[string]interface{}
+}
+
+// loadB4Tracking loads the b4 tracking data of a branch. nil is returned if
+// the branch isn't managed by b4 prep.
+func loadB4Tracking(branch string, coverCommit *logCommit) (*b4Tracking, error) {
+	if coverCommit != nil {
+		if _, s := parseCoverCommitMessage(coverCommit.Message); s != "" {
+			return parseB4Tracking(branch, coverCommit, s)
+		}
+	}
+	if branch == "" {
+		return nil, nil
+	}
+
+	s, ok, err := lookupGitConfig("branch." + branch + ".b4-tracking")
+	if err != nil || !ok {
+		return nil, err
+	}
+	return parseB4Tracking(branch, nil, s)
+}
+
+// loadSeriesB4Tracking is like loadB4Tracking, but looks up the cover letter
+// commit of the series.
+func loadSeriesB4Tracking(ctx context.Context, branch, baseBranch, tip string) (*b4Tracking, error) {
+	var coverCommit *logCommit
+	if baseBranch != "" {
+		mode, err := loadCoverLetterMode()
+		if err != nil {
+			return nil, err
+		}
+		commits, err := loadGitLog(ctx, baseBranch+".."+revOrHead(tip))
+		if err != nil {
+			return nil, err
+		}
+		coverCommit = findCoverCommit(commits, mode)
+	}
+	return loadB4Tracking(branch, coverCommit)
+}
+
+func parseB4Tracking(branch string, commit *logCommit, s string) (*b4Tracking, error) {
+	// Strip the marker and comments preceding the JSON
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if strings.HasPrefix(l, b4TrackingMarker) || strings.HasPrefix(l, "#") {
+			continue
+		}
+		lines = append(lines, l)
+	}
+
+	t := &b4Tracking{Branch: branch, Commit: commit}
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &t.data); err != nil {
+		return nil, fmt.Errorf("failed to parse b4 tracking data: %v", err)
+	}
+	if t.data == nil {
+		t.data = make(map[string]interface{})
+	}
+	return t, nil
+}
+
+func (t *b4Tracking) series() map[string]interface{} {
+	series, ok := t.data["series"].(map[string]interface{})
+	if !ok {
+		series = make(map[string]interface{})
+		t.data["series"] = series
+	}
+	return series
+}
+
+func (t *b4Tracking) ChangeID() string {
+	s, _ := t.series()["change-id"].(string)
+	return s
+}
+
+// Revision returns the next version to send, or 0 if unknown.
+func (t *b4Tracking) Revision() int {
+	f, _ := t.series()["revision"].(float64)
+	return int(f)
+}
+
+// SentVersions returns the versions sent, oldest first. Only the version and
+// Message-ID are known.
+func (t *b4Tracking) SentVersions() []sentVersion {
+	history, _ := t.series()["history"].(map[string]interface{})
+
+	var l []sentVersion
+	for k, v := range history {
+		n, err := strconv.Atoi(strings.TrimPrefix(k, "v"))
+		if err != nil {
+			continue
+		}
+		msgIDs, _ := v.([]interface{})
+		if len(msgIDs) == 0 {
+			continue
+		}
+		// A version may have been sent multiple times, the latest wins
+		msgID, _ := msgIDs[len(msgIDs)-1].(string)
+		if msgID == "" {
+			continue
+		}
+		l = append(l, sentVersion{Version: strconv.Itoa(n), MessageID: strings.Trim(msgID, "<>")})
+	}
+	sortSentVersions(l)
+	return l
+}
+
+// mergeSentVersions adds the versions sent with b4 to the ones sent with
+// pyonji.
+func (t *b4Tracking) mergeSentVersions(versions []sentVersion) []sentVersion {
+	if t == nil {
+		return versions
+	}
+
+	known := make(map[string]bool)
+	for _, v := range versions {
+		known[normalizeVersion(v.Version)] = true
+	}
+	merged := versions
+	for _, v := range t.SentVersions() {
+		if !known[v.Version] {
+			merged = append(merged, v)
+		}
+	}
+	if len(merged) == len(versions) {
+		return versions
+	}
+	merged = append([]sentVersion(nil), merged...)
+	sortSentVersions(merged)
+	return merged
+}
+
+// nextRerollCount returns the version to send next. The b4 revision is used
+// if a newer version has been sent with b4 than with pyonji, since pyonji
+// doesn't know about it otherwise.
+func (t *b4Tracking) nextRerollCount(rerollCount string, versions []sentVersion) string {
+	if t == nil {
+		return rerollCount
+	}
+
+	latest := func(l []sentVersion) int {
+		max := 0
+		for _, v := range l {
+			if n, _ := strconv.Atoi(normalizeVersion(v.Version)); n > max {
+				max = n
+			}
+		}
+		return max
+	}
+	if latest(t.SentVersions()) <= latest(versions) {
+		return rerollCount
+	}
+
+	cur, err := strconv.Atoi(rerollCount)
+	if err != nil {
+		cur = 1
+	}
+	if rev := t.Revision(); rev > cur {
+		return strconv.Itoa(rev)
+	}
+	return rerollCount
+}
+
+// recordSent adds a sent version to the history, and bumps the revision like
+// b4 send does.
+func (t *b4Tracking) recordSent(version, msgID string) {
+	version = normalizeVersion(version)
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		return
+	}
+
+	series := t.series()
+	history, ok := series["history"].(map[string]interface{})
+	if !ok {
+		history = make(map[string]interface{})
+		series["history"] = history
+	}
+	k := "v" + version
+	msgIDs, _ := history[k].([]interface{})
+	history[k] = append(msgIDs, strings.Trim(msgID, "<>"))
+
+	if n+1 > t.Revision() {
+		series["revision"] = n + 1
+	}
+}
+
+// save writes the tracking data back. If it's stored in the cover letter
+// commit, the commit is rewritten and the branch is rebased on top of it.
+func (t *b4Tracking) save() error {
+	if t.Commit == nil {
+		b, err := json.Marshal(t.data)
+		if err != nil {
+			return err
+		}
+		return setGitConfig("branch."+t.Branch+".b4-tracking", string(b))
+	}
+
+	b, err := json.MarshalIndent(t.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tracking := b4TrackingMarker + "\n" +
+		"# This section is used internally by b4 prep for tracking purposes.\n" +
+		string(b) + "\n"
+	coverLetter, _ := parseCoverCommitMessage(t.Commit.Message)
+	msg := formatCoverCommitMessage(coverLetter, tracking)
+
+	commit, err := createGitEmptyCommit(t.Commit.Hash+"^", msg)
+	if err != nil {
+		return err
+	}
+	if err := rebaseGitBranch(t.Branch, commit, t.Commit.Hash); err != nil {
+		return err
+	}
+	t.Commit = &logCommit{Hash: commit, Subject: t.Commit.Subject, Author: t.Commit.Author, Message: msg}
+	return nil
+}
+
+// recordB4SentVersion records a sent submission in the b4 tracking data of
+// the branch, if any, so that b4 send picks up where pyonji left off.
+func recordB4SentVersion(state *outboxState) error {
+	if state.Branch == "" || len(state.Messages) == 0 {
+		return nil
+	}
+
+	// The base of a submission is its cover letter commit, if any
+	var coverCommit *logCommit
+	if state.Base != "" {
+		commits, err := loadGitLog(context.Background(), "--max-count=1", state.Base)
+		if err != nil {
+			return err
+		}
+		coverCommit = findCoverCommit(commits, coverLetterModeDescription)
+	}
+
+	tracking, err := loadB4Tracking(state.Branch, coverCommit)
+	if err != nil || tracking == nil {
+		return err
+	}
+
+	// Only rewrite the cover letter commit if the whole checked out branch has
+	// been sent, to avoid surprises
+	if tracking.Commit != nil {
+		head, err := getGitCommit("HEAD")
+		if err != nil {
+			return err
+		}
+		if findGitCurrentBranch() != state.Branch || head != state.Commit {
+			return nil
+		}
+	}
+
+	tracking.recordSent(state.Version, state.Messages[0].MessageID)
+	if err := tracking.save(); err != nil {
+		return err
+	}
+
+	if tracking.Commit != nil {
+		state.Base = tracking.Commit.Hash
+		state.Commit, err = getGitCommit("HEAD")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func normalizeVersion(version string) string {
+	if version == "" {
+		return "1"
+	}
+	return version
+}
+
+func sortSentVersions(l []sentVersion) {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, _ := strconv.Atoi(normalizeVersion(l[i].Version))
+		b, _ := strconv.Atoi(normalizeVersion(l[j].Version))
+		return a < b
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// Exit codes of the batch mode
+const (
+	batchExitOK        = 0
+	batchExitFailure   = 1 // nothing has been sent
+	batchExitInvalid   = 2 // the submission is invalid
+	batchExitPartial   = 3 // some messages have been sent, use --resume
+	batchExitNoChanges = 4
+)
+
+type batchReport struct {
+	Branch   string               `json:"branch,omitempty"`
+	Version  string               `json:"version,omitempty"`
+	To       []string             `json:"to,omitempty"`
+	Cc       []string             `json:"cc,omitempty"`
+	Warnings []string             `json:"warnings,omitempty"`
+	Output   string               `json:"output,omitempty"`
+	Messages []batchReportMessage `json:"messages,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	// Checks which failed, if the error is a validation failure
+	ValidationFailures []validationFailure `json:"validation_failures,omitempty"`
+}
+
+type batchReportMessage struct {
+	MessageID  string   `json:"message_id"`
+	Subject    string   `json:"subject"`
+	Recipients []string `json:"recipients"`
+	Status     string   `json:"status"` // "sent", "pending" or "saved"
+}
+
+// runBatch sends a submission without any user interaction, prints a JSON
+// report on stdout and returns the process exit code.
+func runBatch(ctx context.Context, gitConfig *gitSendEmailConfig, flags *submitFlags) int {
+	var report batchReport
+	code := sendBatch(ctx, gitConfig, flags, &report)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+		return batchExitFailure
+	}
+	return code
+}
+
+func sendBatch(ctx context.Context, gitConfig *gitSendEmailConfig, flags *submitFlags, report *batchReport) int {
+	fail := func(code int, err error) int {
+		report.Error = err.Error()
+		return code
+	}
+
+	if flags.dryRun && flags.resume {
+		return fail(batchExitInvalid, fmt.Errorf("--dry-run and --resume are mutually exclusive: interrupted submissions can only be resumed by sending them"))
+	} else if flags.dryRun {
+		// No mail server is needed to save mails locally
+	} else if gitConfig == nil {
+		return fail(batchExitFailure, fmt.Errorf("no mail server configured, run pyonji interactively first"))
+	} else if smtpConfig := gitConfig.SMTP; smtpConfig != nil && smtpConfig.needsPassword() {
+		if err := smtpConfig.fillCredential(false); err != nil {
+			return fail(batchExitFailure, err)
+		}
+	}
+
+	var ob *outbox
+	if !flags.dryRun {
+		// Nothing is sent in dry-run mode, leave any pending outbox alone
+		var err error
+		ob, err = loadOutbox()
+		if err != nil {
+			return fail(batchExitFailure, err)
+		}
+	}
+	if flags.resume {
+		if ob == nil {
+			return fail(batchExitInvalid, fmt.Errorf("no interrupted submission to resume"))
+		}
+	} else if ob != nil {
+		return fail(batchExitInvalid, fmt.Errorf("a previous submission was interrupted, use --resume to send the remaining messages"))
+	} else {
+		headBranch := findGitCurrentBranch()
+		cfg, err := loadInitialSubmissionConfig(ctx, headBranch, flags)
+		if err != nil {
+			return fail(batchExitInvalid, err)
+		} else if cfg.baseBranch == "" {
+			return fail(batchExitInvalid, fmt.Errorf("failed to find base branch, use --base to specify it"))
+		}
+
+		report.Branch = headBranch
+		report.Version = cfg.rerollCount
+		if report.Version == "" {
+			report.Version = "1"
+		}
+		report.To = addressStrings(cfg.to)
+		report.Cc = addressStrings(cfg.cc)
+
+		var (
+			commits     []logCommit
+			coverLetter string
+		)
+		switch msg := loadSubmissionLog(ctx, cfg.baseBranch, cfg.tip, headBranch, cfg.changeID, cfg.identity).(type) {
+		case error:
+			return fail(batchExitFailure, msg)
+		case submissionLog:
+			commits = msg.commits
+			coverLetter = msg.coverLetter
+			if msg.coverCommit != nil {
+				cfg.coverCommit = msg.coverCommit.Hash
+			}
+			if msg.sameAsPrevSubmission {
+				report.Warnings = append(report.Warnings, "This version has already been submitted")
+			}
+			report.Warnings = append(report.Warnings, msg.warnings...)
+		}
+		if len(commits) == 0 {
+			return fail(batchExitNoChanges, fmt.Errorf("there are no changes"))
+		}
+		if err := validateSubmission(commits, formatAddressList(cfg.to), formatAddressList(cfg.cc), cfg.rerollCount); err != nil {
+			return fail(batchExitInvalid, err)
+		}
+
+		from, err := loadGitSendEmailFrom(cfg.identity)
+		if err != nil {
+			return fail(batchExitFailure, err)
+		}
+		patches, err := formatGitPatches(ctx, cfg.baseBranch, cfg.tip, &gitFormatPatchOptions{CoverCommit: cfg.coverCommit})
+		if err != nil {
+			return fail(batchExitFailure, err)
+		}
+		lintWarnings, err := lintSeries(ctx, cfg.baseBranch, cfg.tip, commits, patches, from)
+		if err != nil {
+			lintWarnings = append(lintWarnings, lintFailureWarning(err))
+		}
+		report.Warnings = append(report.Warnings, lintWarnings...)
+
+		sentVersions, err := loadSentVersions(headBranch, cfg.changeID)
+		if err != nil {
+			return fail(batchExitFailure, err)
+		}
+		sentVersions = cfg.b4Tracking.mergeSentVersions(sentVersions)
+		prev := findPrevVersion(sentVersions, cfg.rerollCount)
+		if cfg.inReplyTo == "" && prev != nil && !cfg.noInReplyToPrev {
+			cfg.inReplyTo = prev.MessageID
+		}
+		if canRangeDiff(prev, len(commits), coverLetter != "") {
+			cfg.rangeDiff = prev
+		}
+
+		if flags.dryRun {
+			return exportBatch(ctx, headBranch, cfg, coverLetter, flags.output, report)
+		}
+
+		var validator *patchValidator
+		if !flags.noValidate {
+			validator, err = loadPatchValidator()
+			if err != nil {
+				return fail(batchExitFailure, err)
+			}
+		}
+
+		ob, err = createSubmissionOutbox(ctx, headBranch, cfg, coverLetter, validator)
+		var validationErr *validationError
+		if errors.As(err, &validationErr) {
+			report.ValidationFailures = validationErr.failures
+			return fail(batchExitInvalid, err)
+		} else if err != nil {
+			return fail(batchExitFailure, err)
+		}
+	}
+
+	ch := make(chan submissionProgress)
+	go func() {
+		for range ch {
+			// Progress is only reported in the final report
+		}
+	}()
+	res := sendOutbox(ctx, ob, gitConfig, ch)
+	close(ch)
+
+	if report.Branch == "" {
+		report.Branch = ob.Branch
+		report.Version = ob.Version
+	}
+	for _, msg := range ob.Messages {
+		status := "pending"
+		if msg.Sent {
+			status = "sent"
+		}
+		report.Messages = append(report.Messages, batchReportMessage{
+			MessageID:  msg.MessageID,
+			Subject:    msg.Subject,
+			Recipients: msg.To,
+			Status:     status,
+		})
+	}
+
+	if progress, ok := res.(submissionProgress); ok {
+		report.Warnings = append(report.Warnings, progress.warnings...)
+	}
+	if err, ok := res.(error); ok {
+		if ob.sentCount() > 0 {
+			return fail(batchExitPartial, err)
+		}
+		return fail(batchExitFailure, err)
+	}
+	return batchExitOK
+}
+
+// exportBatch saves a submission to a local mailbox.
+func exportBatch(ctx context.Context, headBranch string, cfg *submissionConfig, coverLetter string, output string, report *batchReport) int {
+	if output == "" {
+		output = defaultMboxPath(headBranch, cfg.rerollCount)
+	}
+	report.Output = output
+
+	state, patches, err := prepareSubmission(ctx, headBranch, cfg, coverLetter)
+	if err != nil {
+		report.Error = err.Error()
+		return batchExitFailure
+	}
+	if _, err := exportPreparedSubmission(ctx, state, patches, output); err != nil {
+		report.Error = err.Error()
+		return batchExitFailure
+	}
+
+	for _, msg := range state.Messages {
+		report.Messages = append(report.Messages, batchReportMessage{
+			MessageID:  msg.MessageID,
+			Subject:    msg.Subject,
+			Recipients: msg.To,
+			Status:     "saved",
+		})
+	}
+	return batchExitOK
+}
+
+func addressStrings(addrs []*mail.Address) []string {
+	l := make([]string, len(addrs))
+	for i, addr := range addrs {
+		l[i] = formatAddressList([]*mail.Address{addr})
+	}
+	return l
+}
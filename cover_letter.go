@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Maximum height of the cover letter editor
+const coverLetterEditorHeight = 12
+
+// b4 prep separates the cover letter from its tracking data with this line
+const b4TrackingMarker = "--- b4-submit-tracking ---"
+
+type coverLetterMode string
+
+const (
+	// The cover letter is stored in the branch description
+	coverLetterModeDescription coverLetterMode = "description"
+	// The cover letter is stored in an empty commit at the bottom of the
+	// branch, like b4 prep does
+	coverLetterModeCommit coverLetterMode = "commit"
+)
+
+func loadCoverLetterMode() (coverLetterMode, error) {
+	v, err := getGitConfig("pyonji.coverLetter")
+	if err != nil {
+		return "", err
+	}
+	switch mode := coverLetterMode(v); mode {
+	case "":
+		return loadB4CoverLetterMode()
+	case coverLetterModeDescription, coverLetterModeCommit:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid pyonji.coverLetter %q", v)
+	}
+}
+
+// loadB4CoverLetterMode maps the b4 prep cover letter strategy to a mode.
+// The tip-commit strategy isn't supported.
+func loadB4CoverLetterMode() (coverLetterMode, error) {
+	strategy, err := getB4Config("prep-cover-strategy")
+	if err != nil {
+		return "", err
+	}
+	if strategy == "commit" {
+		return coverLetterModeCommit, nil
+	}
+	return coverLetterModeDescription, nil
+}
+
+// findCoverCommit returns the cover letter commit of a series, if any: an
+// empty commit at the bottom of the series, created by b4 prep or in commit
+// mode. Commits are listed newest first.
+func findCoverCommit(commits []logCommit, mode coverLetterMode) *logCommit {
+	if len(commits) == 0 {
+		return nil
+	}
+	commit := &commits[len(commits)-1]
+	if mode != coverLetterModeCommit && !strings.Contains(commit.Message, b4TrackingMarker) {
+		return nil
+	}
+	if !checkGitEmptyCommit(commit.Hash) {
+		return nil
+	}
+	return commit
+}
+
+// parseCoverCommitMessage splits the message of a cover letter commit into the
+// cover letter and the b4 tracking data, if any.
+func parseCoverCommitMessage(msg string) (coverLetter, tracking string) {
+	if i := strings.Index(msg, b4TrackingMarker); i >= 0 {
+		msg, tracking = msg[:i], msg[i:]
+	}
+	return normalizeBranchDescription(msg), tracking
+}
+
+func formatCoverCommitMessage(coverLetter, tracking string) string {
+	msg := coverLetter
+	if msg != "" && tracking != "" {
+		msg += "\n"
+	}
+	return msg + tracking
+}
+
+// loadSeriesCoverLetter loads the cover letter from the cover letter commit of
+// the series if any, or from the branch description.
+func loadSeriesCoverLetter(headBranch string, commits []logCommit) (string, *logCommit, error) {
+	mode, err := loadCoverLetterMode()
+	if err != nil {
+		return "", nil, err
+	}
+	if commit := findCoverCommit(commits, mode); commit != nil {
+		coverLetter, _ := parseCoverCommitMessage(commit.Message)
+		return coverLetter, commit, nil
+	}
+	coverLetter, err := loadGitBranchDescription(headBranch)
+	return coverLetter, nil, err
+}
+
+// saveSeriesCoverLetter saves the cover letter in the cover letter commit of
+// the series if any (creating it in commit mode), or in the branch
+// description. It returns true if the branch has been rewritten.
+func saveSeriesCoverLetter(headBranch, baseBranch string, commit *logCommit, mode coverLetterMode, coverLetter string) (bool, error) {
+	coverLetter = normalizeBranchDescription(coverLetter)
+	if commit == nil && mode != coverLetterModeCommit {
+		return false, saveGitBranchDescription(headBranch, coverLetter)
+	}
+
+	var parent, old, msg string
+	if commit != nil {
+		// Keep the b4 tracking data
+		_, tracking := parseCoverCommitMessage(commit.Message)
+		msg = formatCoverCommitMessage(coverLetter, tracking)
+		parent, old = commit.Hash+"^", commit.Hash
+	} else if coverLetter != "" {
+		base, err := getGitMergeBase(baseBranch, "HEAD")
+		if err != nil {
+			return false, err
+		}
+		parent, old, msg = base, base, coverLetter
+	} else {
+		return false, nil
+	}
+
+	// An empty message drops the cover letter commit
+	onto := parent
+	if msg != "" {
+		var err error
+		onto, err = createGitEmptyCommit(parent, msg)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, rebaseGitBranch(headBranch, onto, old)
+}
+
+func createGitEmptyCommit(parent, msg string) (string, error) {
+	cmd := exec.Command("git", "commit-tree", parent+"^{tree}", "-p", parent, "-F", "-")
+	cmd.Stdin = strings.NewReader(msg)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to create cover letter commit: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// rebaseGitBranch moves the commits of a branch after upstream on top of onto.
+func rebaseGitBranch(branch, onto, upstream string) error {
+	cmd := exec.Command("git", "rebase", "--quiet", "--autostash", "--onto", onto, upstream, branch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to rebase branch: %v: %v", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func newCoverLetterEditor() textarea.Model {
+	editor := textarea.New()
+	editor.Placeholder = "Subject\n\nDescription of the series"
+	editor.CharLimit = 0
+	editor.MaxHeight = 0
+	editor.Prompt = ""
+	return editor
+}
+
+// splitCoverLetter splits a branch description into the subject and body of
+// the cover letter, like git format-patch --cover-from-description=subject:
+// the first paragraph is the subject.
+func splitCoverLetter(desc string) (subject, body string) {
+	desc = strings.TrimLeft(strings.ReplaceAll(desc, "\r\n", "\n"), "\n")
+	subject, body, _ = strings.Cut(desc, "\n\n")
+	subject = strings.Join(strings.Fields(subject), " ")
+	return subject, strings.TrimSpace(body)
+}
+
+func (m submitModel) editCoverLetter() (tea.Model, tea.Cmd) {
+	m.editingCoverLetter = true
+	m.coverLetterEditor.SetValue(strings.TrimRight(m.coverLetter, "\n"))
+	m = m.resizeCoverLetterEditor()
+	return m, m.coverLetterEditor.Focus()
+}
+
+func (m submitModel) resizeCoverLetterEditor() submitModel {
+	// Leave room for the padding
+	if m.width > 2 {
+		m.coverLetterEditor.SetWidth(m.width - 2)
+	}
+	height := coverLetterEditorHeight
+	if m.height > 0 && m.height/2 < height {
+		height = m.height / 2
+	}
+	m.coverLetterEditor.SetHeight(height)
+	return m
+}
+
+func (m submitModel) updateCoverLetterEditor(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		m.editingCoverLetter = false
+		m.coverLetterEditor.Blur()
+		coverLetter := normalizeBranchDescription(m.coverLetterEditor.Value())
+		if coverLetter == m.coverLetter {
+			return m, nil
+		}
+		return m, func() tea.Msg {
+			rewritten, err := saveSeriesCoverLetter(m.headBranch, m.baseBranch, m.coverCommit, m.coverLetterMode, coverLetter)
+			if err != nil {
+				return err
+			}
+			return coverLetterUpdated{coverLetter: coverLetter, rewritten: rewritten}
+		}
+	case "ctrl+o":
+		return m, m.editCoverLetterExternally()
+	case "ctrl+r":
+		if !m.checkForm() {
+			break
+		}
+		coverLetter := normalizeBranchDescription(m.coverLetterEditor.Value())
+		m.loadingMsg = "Preparing preview..."
+		return m, func() tea.Msg {
+			return m.loadCoverLetterPreview(coverLetter)
+		}
+	case "ctrl+c":
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.coverLetterEditor, cmd = m.coverLetterEditor.Update(msg)
+	return m, cmd
+}
+
+// editCoverLetterExternally opens the cover letter being edited in the Git
+// editor.
+func (m submitModel) editCoverLetterExternally() tea.Cmd {
+	editor, err := getGitEditor()
+	if err != nil {
+		return func() tea.Msg { return err }
+	}
+
+	f, err := os.CreateTemp("", "pyonji-cover-letter-*.txt")
+	if err != nil {
+		return func() tea.Msg { return fmt.Errorf("failed to create temporary file: %v", err) }
+	}
+	_, err = f.WriteString(m.coverLetterEditor.Value())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return func() tea.Msg { return fmt.Errorf("failed to write temporary file: %v", err) }
+	}
+
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "-", f.Name())
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		defer os.Remove(f.Name())
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(f.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read temporary file: %v", err)
+		}
+		return coverLetterEdited{string(b)}
+	})
+}
+
+// loadCoverLetterPreview renders the cover letter which would be sent, with
+// the shortlog and diffstat of the series.
+func (m submitModel) loadCoverLetterPreview(coverLetter string) tea.Msg {
+	if coverLetter == "" {
+		return patchPreview{title: "Cover letter", content: warningStyle.Render("⚠ The cover letter is empty, none will be sent")}
+	}
+	cfg, err := m.submissionConfig()
+	if err != nil {
+		return err
+	}
+	_, patches, err := prepareSubmission(m.ctx, m.headBranch, cfg, coverLetter)
+	if err != nil {
+		return err
+	} else if len(patches) == 0 {
+		return fmt.Errorf("failed to generate cover letter")
+	}
+	return patchPreview{title: "Cover letter", content: renderPatchPreview(&patches[0])}
+}
+
+func (m submitModel) coverLetterEditorView() string {
+	var sb strings.Builder
+
+	subject, body := splitCoverLetter(m.coverLetterEditor.Value())
+	if subject == "" {
+		subject = "none"
+	}
+	field := formField{Label: "Cover letter subject", Text: subject, Active: true}
+	sb.WriteString(field.View())
+	if utf8.RuneCountInString(subject) > lintMaxSubjectLen {
+		sb.WriteString(" " + warningStyle.Render(fmt.Sprintf("⚠ longer than %v characters", lintMaxSubjectLen)))
+	}
+	sb.WriteString("\n")
+	hint := "The first paragraph is the subject, followed by the body"
+	if body != "" {
+		hint = "Body: " + pluralize("line", strings.Count(body, "\n")+1)
+	}
+	sb.WriteString(labelStyle.Render(hint) + "\n\n")
+
+	sb.WriteString(m.coverLetterEditor.View() + "\n\n")
+	if m.loadingMsg != "" {
+		sb.WriteString(m.spinner.View() + m.loadingMsg + "\n")
+	} else {
+		sb.WriteString(labelStyle.Render("Press Esc to save, Ctrl-O to open in an external editor, Ctrl-R to preview the cover letter") + "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestSplitCoverLetter(t *testing.T) {
+	tests := []struct {
+		name          string
+		desc          string
+		subject, body string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "subject only",
+			desc:    "Add the foo feature\n",
+			subject: "Add the foo feature",
+		},
+		{
+			name:    "subject and body",
+			desc:    "Add the foo feature\n\nThis adds foo.\n\nAnd bar.\n",
+			subject: "Add the foo feature",
+			body:    "This adds foo.\n\nAnd bar.",
+		},
+		{
+			name:    "multi-line subject",
+			desc:    "Add the foo\nfeature\n\nThis adds foo.",
+			subject: "Add the foo feature",
+			body:    "This adds foo.",
+		},
+		{
+			name:    "leading blank lines",
+			desc:    "\n\nAdd the foo feature\n\nThis adds foo.",
+			subject: "Add the foo feature",
+			body:    "This adds foo.",
+		},
+		{
+			name:    "CRLF",
+			desc:    "Add the foo feature\r\n\r\nThis adds foo.\r\n",
+			subject: "Add the foo feature",
+			body:    "This adds foo.",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subject, body := splitCoverLetter(tc.desc)
+			if subject != tc.subject || body != tc.body {
+				t.Errorf("splitCoverLetter() = %q, %q, want %q, %q", subject, body, tc.subject, tc.body)
+			}
+		})
+	}
+}
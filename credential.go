@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gitCredential is a credential as described in gitcredentials(7).
+type gitCredential struct {
+	Protocol string
+	Host     string
+	Username string
+	Password string
+}
+
+func (cred *gitCredential) format() string {
+	var sb strings.Builder
+	kvs := []struct{ k, v string }{
+		{"protocol", cred.Protocol},
+		{"host", cred.Host},
+		{"username", cred.Username},
+		{"password", cred.Password},
+	}
+	for _, kv := range kvs {
+		if kv.v != "" {
+			fmt.Fprintf(&sb, "%v=%v\n", kv.k, kv.v)
+		}
+	}
+	return sb.String()
+}
+
+func runGitCredential(op string, cred *gitCredential, interactive bool) ([]byte, error) {
+	cmd := exec.Command("git", "credential", op)
+	cmd.Stdin = strings.NewReader(cred.format())
+	if interactive {
+		cmd.Stderr = os.Stderr
+	} else {
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git credential %v failed: %v", op, err)
+	}
+	return out, nil
+}
+
+// fillGitCredential asks Git credential helpers for the missing fields of the
+// credential. If interactive is set, Git may prompt the user on the terminal.
+func fillGitCredential(cred *gitCredential, interactive bool) error {
+	out, err := runGitCredential("fill", cred, interactive)
+	if err != nil {
+		return err
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		k, v, _ := strings.Cut(sc.Text(), "=")
+		switch k {
+		case "username":
+			cred.Username = v
+		case "password":
+			cred.Password = v
+		}
+	}
+	return sc.Err()
+}
+
+// approveGitCredential asks Git credential helpers to store the credential.
+func approveGitCredential(cred *gitCredential) error {
+	_, err := runGitCredential("approve", cred, false)
+	return err
+}
+
+// rejectGitCredential asks Git credential helpers to erase the credential.
+func rejectGitCredential(cred *gitCredential) error {
+	_, err := runGitCredential("reject", cred, false)
+	return err
+}
+
+// hasGitCredentialHelper checks whether a Git credential helper is configured
+// for the credential, including URL-specific ones such as
+// credential.smtp://example.org.helper.
+func hasGitCredentialHelper(cred *gitCredential) (bool, error) {
+	u := url.URL{Scheme: cred.Protocol, Host: cred.Host}
+	if cred.Username != "" {
+		u.User = url.User(cred.Username)
+	}
+	cmd := exec.Command("git", "config", "--get-urlmatch", "credential.helper", u.String())
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil // no match
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get Git config \"credential.helper\": %v", err)
+	}
+	// An empty value resets the list of helpers
+	return strings.TrimSpace(string(out)) != "", nil
+}
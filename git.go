@@ -4,12 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-mbox"
 	"github.com/emersion/go-message"
@@ -26,6 +31,31 @@ func getGitConfig(key string) (string, error) {
 	return strings.TrimSpace(string(b)), nil
 }
 
+// lookupGitConfig is like getGitConfig, but distinguishes unset keys from keys
+// set to an empty value.
+func lookupGitConfig(key string) (value string, ok bool, err error) {
+	return lookupGitConfigWithArgs(key)
+}
+
+// lookupGitConfigPath is like lookupGitConfig, but values are interpreted as
+// paths.
+func lookupGitConfigPath(key string) (value string, ok bool, err error) {
+	return lookupGitConfigWithArgs(key, "--type=path")
+}
+
+func lookupGitConfigWithArgs(key string, args ...string) (value string, ok bool, err error) {
+	args = append(append([]string{"config"}, args...), "--get", key)
+	cmd := exec.Command("git", args...)
+	b, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to get Git config %q: %v", key, err)
+	}
+	return strings.TrimSpace(string(b)), true, nil
+}
+
 func getAllGitConfig(key string) ([]string, error) {
 	// --get-all does not support --default
 	first, err := getGitConfig(key)
@@ -47,6 +77,15 @@ func getAllGitConfig(key string) ([]string, error) {
 	return strings.Split(s, "\n"), nil
 }
 
+func getGitConfigBool(key string, def bool) (bool, error) {
+	cmd := exec.Command("git", "config", "--type=bool", "--default="+strconv.FormatBool(def), key)
+	b, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to get Git config %q: %v", key, err)
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(b)))
+}
+
 func setGitConfig(key, value string) error {
 	cmd := exec.Command("git", "config", key, value)
 	if err := cmd.Run(); err != nil {
@@ -55,6 +94,36 @@ func setGitConfig(key, value string) error {
 	return nil
 }
 
+func addGitConfig(key, value string) error {
+	cmd := exec.Command("git", "config", "--add", key, value)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to add Git config %q: %v", key, err)
+	}
+	return nil
+}
+
+// replaceGitConfig replaces the values of a multi-valued key matching a
+// regular expression.
+func replaceGitConfig(key, value, valueRegexp string) error {
+	cmd := exec.Command("git", "config", "--replace-all", key, value, valueRegexp)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to replace Git config %q: %v", key, err)
+	}
+	return nil
+}
+
+func unsetAllGitConfig(key string) error {
+	cmd := exec.Command("git", "config", "--unset-all", key)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 5 {
+		return nil // key not set
+	} else if err != nil {
+		return fmt.Errorf("failed to unset Git config %q: %v", key, err)
+	}
+	return nil
+}
+
 func setGitGlobalConfig(key, value string) error {
 	cmd := exec.Command("git", "config", "--global", key, value)
 	if err := cmd.Run(); err != nil {
@@ -63,6 +132,9 @@ func setGitGlobalConfig(key, value string) error {
 	return nil
 }
 
+// saveGitSendEmailConfig saves SMTP settings in the global Git config. The
+// password is left to Git credential helpers, but the OAuth2 token command is
+// saved.
 func saveGitSendEmailConfig(cfg *smtpConfig) error {
 	enc := "ssl"
 	if cfg.StartTLS {
@@ -74,7 +146,9 @@ func saveGitSendEmailConfig(cfg *smtpConfig) error {
 		{"smtpServerPort", cfg.Port},
 		{"smtpEncryption", enc},
 		{"smtpUser", cfg.Username},
-		{"smtpPass", cfg.Password}, // TODO: do not store as plaintext
+	}
+	if cfg.TokenSource != nil && cfg.TokenSource.Cmd != "" {
+		kvs = append(kvs, struct{ k, v string }{"smtpOAuthTokenCmd", cfg.TokenSource.Cmd})
 	}
 	for _, kv := range kvs {
 		if err := setGitGlobalConfig("sendemail."+kv.k, kv.v); err != nil {
@@ -89,18 +163,131 @@ type gitSendEmailConfig struct {
 	Sendmail *sendmailConfig
 }
 
-func loadGitSendEmailConfig() (*gitSendEmailConfig, error) {
-	var server, port, enc, user, pass, sendmailCmd string
+// sendEmailConfigKey returns the Git config key holding a git-send-email
+// option. Options in the sendemail.<identity> section take precedence over
+// the ones in the sendemail section.
+func sendEmailConfigKey(identity, key string) (string, error) {
+	if identity != "" {
+		k := "sendemail." + identity + "." + key
+		if _, ok, err := lookupGitConfig(k); err != nil {
+			return "", err
+		} else if ok {
+			return k, nil
+		}
+	}
+	return "sendemail." + key, nil
+}
+
+// pyonjiIdentityConfigKey is like sendEmailConfigKey, for pyonji options
+// specific to a sendemail identity: options in the pyonji.<identity> section
+// take precedence over the ones in the pyonji section.
+func pyonjiIdentityConfigKey(identity, key string) (string, error) {
+	if identity != "" {
+		k := "pyonji." + identity + "." + key
+		if _, ok, err := lookupGitConfig(k); err != nil {
+			return "", err
+		} else if ok {
+			return k, nil
+		}
+	}
+	return "pyonji." + key, nil
+}
+
+func getSendEmailConfig(identity, key string) (string, error) {
+	k, err := sendEmailConfigKey(identity, key)
+	if err != nil {
+		return "", err
+	}
+	return getGitConfig(k)
+}
+
+func getAllSendEmailConfig(identity, key string) ([]string, error) {
+	k, err := sendEmailConfigKey(identity, key)
+	if err != nil {
+		return nil, err
+	}
+	return getAllGitConfig(k)
+}
+
+func lookupSendEmailConfigPath(identity, key string) (value string, ok bool, err error) {
+	k, err := sendEmailConfigKey(identity, key)
+	if err != nil {
+		return "", false, err
+	}
+	return lookupGitConfigPath(k)
+}
+
+// listSendEmailIdentities returns the names of the sendemail.<identity>
+// sections.
+func listSendEmailIdentities() ([]string, error) {
+	cmd := exec.Command("git", "config", "--name-only", "--get-regexp", `^sendemail\..+\.`)
+	b, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, nil // no match
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list sendemail identities: %v", err)
+	}
+
+	var identities []string
+	seen := make(map[string]bool)
+	for _, k := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		k = strings.TrimPrefix(k, "sendemail.")
+		i := strings.LastIndexByte(k, '.')
+		if i <= 0 || seen[k[:i]] {
+			continue
+		}
+		seen[k[:i]] = true
+		identities = append(identities, k[:i])
+	}
+	sort.Strings(identities)
+	return identities, nil
+}
+
+// loadSendEmailIdentity picks the identity to send a branch with: the one
+// passed on the command line, the one last used for the branch, or
+// sendemail.identity.
+func loadSendEmailIdentity(branch, changeID, flag string) (string, error) {
+	if flag != "" {
+		identities, err := listSendEmailIdentities()
+		if err != nil {
+			return "", err
+		}
+		for _, identity := range identities {
+			if identity == flag {
+				return flag, nil
+			}
+		}
+		return "", fmt.Errorf("unknown sendemail identity %q", flag)
+	}
+
+	if branch != "" {
+		k, err := seriesConfigKey(branch, changeID, "pyonjiIdentity")
+		if err != nil {
+			return "", err
+		}
+		identity, err := getGitConfig(k)
+		if err != nil || identity != "" {
+			return identity, err
+		}
+	}
+
+	return getGitConfig("sendemail.identity")
+}
+
+func loadGitSendEmailConfig(identity string) (*gitSendEmailConfig, error) {
+	var server, port, enc, user, pass, auth, sendmailCmd string
 	entries := map[string]*string{
 		"smtpServer":     &server,
 		"smtpServerPort": &port,
 		"smtpEncryption": &enc,
 		"smtpUser":       &user,
 		"smtpPass":       &pass,
+		"smtpAuth":       &auth,
 		"sendmailCmd":    &sendmailCmd,
 	}
 	for k, ptr := range entries {
-		v, err := getGitConfig("sendemail." + k)
+		v, err := getSendEmailConfig(identity, k)
 		if err != nil {
 			return nil, err
 		}
@@ -150,11 +337,42 @@ func loadGitSendEmailConfig() (*gitSendEmailConfig, error) {
 		}
 		cfg.SMTP.Username = user
 		cfg.SMTP.Password = pass
+
+		timeoutKey, err := pyonjiIdentityConfigKey(identity, "smtpTimeout")
+		if err != nil {
+			return nil, err
+		}
+		if timeout, err := getGitConfig(timeoutKey); err != nil {
+			return nil, err
+		} else if timeout != "" {
+			cfg.SMTP.Timeout, err = time.ParseDuration(timeout)
+			if err != nil || cfg.SMTP.Timeout <= 0 {
+				return nil, fmt.Errorf("invalid %v %q", timeoutKey, timeout)
+			}
+		}
+
+		if err := loadGitSendEmailTLSConfig(cfg.SMTP, identity); err != nil {
+			return nil, err
+		}
+
+		// git-send-email accepts a whitespace-separated list of mechanisms,
+		// or "none" to disable authentication
+		if strings.EqualFold(auth, "none") {
+			cfg.SMTP.NoAuth = true
+		} else {
+			cfg.SMTP.AuthMechs = strings.Fields(strings.ToUpper(auth))
+		}
+
+		tokenSource, err := loadOAuth2TokenSource(identity)
+		if err != nil {
+			return nil, err
+		}
+		cfg.SMTP.TokenSource = tokenSource
 	} else {
 		cfg.Sendmail = new(sendmailConfig)
 		cfg.Sendmail.Cmd = sendmailCmd
 
-		opts, err := getAllGitConfig("sendemail.smtpServerOption")
+		opts, err := getAllSendEmailConfig(identity, "smtpServerOption")
 		if err != nil {
 			return nil, err
 		}
@@ -163,8 +381,54 @@ func loadGitSendEmailConfig() (*gitSendEmailConfig, error) {
 	return &cfg, nil
 }
 
-func loadGitSendEmailTo() ([]*mail.Address, error) {
-	v, err := getGitConfig("sendemail.to")
+func loadGitSendEmailTLSConfig(cfg *smtpConfig, identity string) error {
+	domain, err := getSendEmailConfig(identity, "smtpDomain")
+	if err != nil {
+		return err
+	}
+	cfg.Domain = domain
+
+	// Like git-send-email, an empty smtpSSLCertPath disables verification
+	certPath, ok, err := lookupSendEmailConfigPath(identity, "smtpSSLCertPath")
+	if err != nil {
+		return err
+	} else if ok && certPath == "" {
+		cfg.InsecureSkipVerify = true
+	} else {
+		cfg.CACertPath = certPath
+	}
+
+	if cfg.ClientCertPath, _, err = lookupSendEmailConfigPath(identity, "smtpSSLClientCert"); err != nil {
+		return err
+	}
+	if cfg.ClientKeyPath, _, err = lookupSendEmailConfigPath(identity, "smtpSSLClientKey"); err != nil {
+		return err
+	}
+	if cfg.ClientKeyPath != "" && cfg.ClientCertPath == "" {
+		return fmt.Errorf("sendemail.smtpSSLClientKey requires sendemail.smtpSSLClientCert")
+	}
+
+	// The pinned certificate belongs to a single server, so unlike other
+	// options the one in the pyonji section doesn't apply to identities
+	k := "pyonji.smtpSSLFingerprint"
+	if identity != "" {
+		k = "pyonji." + identity + ".smtpSSLFingerprint"
+	}
+	fingerprint, err := getGitConfig(k)
+	if err != nil {
+		return err
+	} else if fingerprint != "" {
+		cfg.CertFingerprint, err = parseCertFingerprint(fingerprint)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", k, err)
+		}
+	}
+
+	return nil
+}
+
+func loadGitSendEmailTo(identity string) ([]*mail.Address, error) {
+	v, err := getSendEmailConfig(identity, "to")
 	if err != nil {
 		return nil, err
 	} else if v == "" {
@@ -177,30 +441,61 @@ func loadGitSendEmailTo() ([]*mail.Address, error) {
 	return addrs, nil
 }
 
+func loadGitSendEmailCc(identity string) ([]*mail.Address, error) {
+	values, err := getAllSendEmailConfig(identity, "cc")
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*mail.Address
+	for _, v := range values {
+		l, err := mail.ParseAddressList(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sendemail.cc: %v", err)
+		}
+		addrs = append(addrs, l...)
+	}
+	return addrs, nil
+}
+
 type logCommit struct {
 	Hash    string
 	Subject string
+	Author  *mail.Address
+	Message string
 }
 
-func loadGitLog(ctx context.Context, revRange string) ([]logCommit, error) {
-	cmd := exec.CommandContext(ctx, "git", "log", "--pretty=format:%H %s", revRange)
+func loadGitLog(ctx context.Context, revArgs ...string) ([]logCommit, error) {
+	// Use NUL to separate fields and record separators between commits, since
+	// commit messages may contain newlines
+	args := append([]string{"log", "--pretty=format:%H%x00%s%x00%an%x00%ae%x00%B%x1e"}, revArgs...)
+	cmd := exec.CommandContext(ctx, "git", args...)
 	b, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load git log: %v", err)
 	}
 
 	var log []logCommit
-	for _, l := range strings.Split(string(b), "\n") {
-		if l == "" {
+	for _, rec := range strings.Split(string(b), "\x1e") {
+		rec = strings.TrimPrefix(rec, "\n")
+		if rec == "" {
 			continue
 		}
-		hash, subject, _ := strings.Cut(l, " ")
-		log = append(log, logCommit{hash, subject})
+		fields := strings.SplitN(rec, "\x00", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("failed to parse git log: invalid record")
+		}
+		log = append(log, logCommit{
+			Hash:    fields[0],
+			Subject: fields[1],
+			Author:  &mail.Address{Name: fields[2], Address: fields[3]},
+			Message: fields[4],
+		})
 	}
 	return log, nil
 }
 
 type patch struct {
+	commit string // empty for the cover letter
 	header mail.Header
 	body   []byte
 }
@@ -212,41 +507,97 @@ func (p *patch) Bytes() []byte {
 	return buf.Bytes()
 }
 
+var nullPrerequisiteRegexp = regexp.MustCompile(`(?m)^prerequisite-patch-id: 0+\r?\n`)
+
+var formatPatchFromLineRegexp = regexp.MustCompile(`(?m)^From ([0-9a-f]{40,64}) Mon Sep 17 00:00:00 2001$`)
+
 type gitFormatPatchOptions struct {
 	RerollCount   string
-	CoverLetter   bool
+	CoverLetter   string // empty if none
 	SubjectPrefix string
+
+	// Previous version of the series, to generate a range-diff against
+	PrevBase, PrevTip string
+
+	// For series based on other series: the mainline branch, used to list
+	// the commits in between as prerequisite patches, and the Message-IDs of
+	// the series depended on
+	MainlineBranch         string
+	PrerequisiteMessageIDs []string
+
+	// Empty commit at the bottom of the series holding the cover letter,
+	// excluded from the patches
+	CoverCommit string
+
+	// Persistent identifier of the series, empty if none
+	ChangeID string
 }
 
-func formatGitPatches(ctx context.Context, baseBranch string, options *gitFormatPatchOptions) ([]patch, error) {
-	baseCommit, err := getGitMergeBase(baseBranch, "HEAD")
+// formatGitPatches formats the commits between baseBranch and tip. An empty
+// tip means HEAD.
+func formatGitPatches(ctx context.Context, baseBranch, tip string, options *gitFormatPatchOptions) ([]patch, error) {
+	mainlineBranch := baseBranch
+	if options.MainlineBranch != "" {
+		mainlineBranch = options.MainlineBranch
+	}
+	baseCommit, err := getGitMergeBase(mainlineBranch, revOrHead(tip))
 	if err != nil {
 		return nil, err
 	}
+	if options.CoverCommit != "" {
+		baseBranch = options.CoverCommit
+	}
 
 	args := []string{"format-patch", "--stdout", "--encode-email-headers"}
 	if options.RerollCount != "" {
 		args = append(args, "--reroll-count="+options.RerollCount)
 	}
-	if options.CoverLetter {
-		args = append(args, "--cover-letter", "--cover-from-description=subject")
+	if options.CoverLetter != "" {
+		// git format-patch can only read the cover letter from the branch
+		// description, fill the placeholders instead
+		args = append(args, "--cover-letter", "--cover-from-description=none")
 	}
 	if options.SubjectPrefix != "" {
 		args = append(args, "--subject-prefix="+options.SubjectPrefix)
 	}
-	args = append(args, "--base="+baseCommit, baseBranch+"..")
+	if options.PrevTip != "" {
+		n, err := countGitCommits(ctx, baseBranch+".."+tip)
+		if err != nil {
+			return nil, err
+		}
+		// A range-diff needs a place to go: either the cover letter or the
+		// lone patch of the series
+		if n == 1 {
+			args = append(args, "--interdiff="+options.PrevTip)
+		} else if options.CoverLetter != "" {
+			args = append(args, "--range-diff="+options.PrevBase+".."+options.PrevTip)
+		}
+	}
+	args = append(args, "--base="+baseCommit, baseBranch+".."+tip)
 
 	cmd := exec.CommandContext(ctx, "git", args...)
-	stdout, err := cmd.StdoutPipe()
+	out, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("failed to format Git patches: %v", err)
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to format Git patches: %v", err)
+
+	// The mbox reader swallows the "From" separator lines, which contain the
+	// commit hashes
+	var commits []string
+	for _, match := range formatPatchFromLineRegexp.FindAllSubmatch(out, -1) {
+		commits = append(commits, string(match[1]))
 	}
 
 	var patches []patch
-	mr := mbox.NewReader(stdout)
+	var footers []string
+	if options.ChangeID != "" {
+		footers = append(footers, "change-id: "+options.ChangeID)
+	}
+	for _, msgID := range options.PrerequisiteMessageIDs {
+		footers = append(footers, "prerequisite-message-id: <"+msgID+">")
+	}
+
+	mr := mbox.NewReader(bytes.NewReader(out))
 	for {
 		r, err := mr.NextMessage()
 		if err == io.EOF {
@@ -266,19 +617,100 @@ func formatGitPatches(ctx context.Context, baseBranch string, options *gitFormat
 			return nil, fmt.Errorf("failed to read Git patch body: %v", err)
 		}
 
+		// The cover letter's separator line contains the tip commit
+		var commit string
+		if i := len(patches); i < len(commits) && !(options.CoverLetter != "" && i == 0) {
+			commit = commits[i]
+		}
+
+		if len(footers) > 0 {
+			b = addBaseTreeFooters(b, footers)
+		}
+
 		patches = append(patches, patch{
+			commit: commit,
 			header: mail.Header{message.Header{header}},
 			body:   b,
 		})
 	}
 
-	if err := cmd.Wait(); err != nil {
-		return nil, fmt.Errorf("failed to format Git patches: %v", err)
+	for i := range patches {
+		// Empty commits such as the cover letter commit have a null patch ID
+		patches[i].body = nullPrerequisiteRegexp.ReplaceAll(patches[i].body, nil)
+	}
+
+	if options.CoverLetter != "" && len(patches) > 0 {
+		if err := fillCoverLetter(&patches[0], options.CoverLetter); err != nil {
+			return nil, err
+		}
 	}
 
 	return patches, nil
 }
 
+// fillCoverLetter replaces the placeholders of a cover letter generated by git
+// format-patch, like --cover-from-description=subject does: the first
+// paragraph is the subject.
+func fillCoverLetter(p *patch, coverLetter string) error {
+	subject, body := splitCoverLetter(coverLetter)
+
+	s, err := p.header.Subject()
+	if err != nil {
+		return fmt.Errorf("failed to parse cover letter subject: %v", err)
+	}
+	p.header.SetSubject(strings.Replace(s, "*** SUBJECT HERE ***", subject, 1))
+
+	if bytes.Contains(p.body, []byte("\r\n")) {
+		body = strings.ReplaceAll(body, "\n", "\r\n")
+	}
+	p.body = bytes.Replace(p.body, []byte("*** BLURB HERE ***"), []byte(body), 1)
+
+	if !p.header.Has("Content-Type") && !isASCII(subject+body) {
+		p.header.Set("MIME-Version", "1.0")
+		p.header.Set("Content-Type", "text/plain; charset=UTF-8")
+		p.header.Set("Content-Transfer-Encoding", "8bit")
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// addBaseTreeFooters adds lines such as change-id and prerequisite-message-id
+// to the base tree information appended by git format-patch, like b4 does.
+// Patches without base tree information are left as-is.
+func addBaseTreeFooters(body []byte, footers []string) []byte {
+	i := bytes.Index(body, []byte("\nbase-commit: "))
+	if i < 0 {
+		return body
+	}
+	i++
+	end := bytes.IndexByte(body[i:], '\n')
+	if end < 0 {
+		return body
+	}
+	end += i + 1
+
+	eol := "\n"
+	if end >= 2 && body[end-2] == '\r' {
+		eol = "\r\n"
+	}
+	var lines []byte
+	for _, footer := range footers {
+		lines = append(lines, footer+eol...)
+	}
+
+	out := append([]byte(nil), body[:end]...)
+	out = append(out, lines...)
+	return append(out, body[end:]...)
+}
+
 func getGitMergeBase(a, b string) (string, error) {
 	cmd := exec.Command("git", "merge-base", a, b)
 	out, err := cmd.Output()
@@ -288,15 +720,69 @@ func getGitMergeBase(a, b string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
-func getGitCurrentCommit() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
+func countGitCommits(ctx context.Context, revRange string) (int, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-list", "--count", "--no-merges", revRange)
 	out, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch current commit: %v", err)
+		return 0, fmt.Errorf("failed to count commits: %v", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+func checkGitCommit(rev string) bool {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	return cmd.Run() == nil
+}
+
+func getGitCommit(rev string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", rev+"^{commit}")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch commit %q: %v", rev, err)
 	}
 	return strings.TrimSpace(string(out)), nil
 }
 
+// parseGitRevRange splits a "<base>..<tip>" range. The tip is left empty if
+// omitted, which means HEAD.
+func parseGitRevRange(s string) (base, tip string) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "...") {
+		// Symmetric differences aren't supported, let validation fail
+		return s, ""
+	}
+	base, tip, _ = strings.Cut(s, "..")
+	return base, tip
+}
+
+// formatGitRevRange is the inverse of parseGitRevRange.
+func formatGitRevRange(base, tip string) string {
+	if tip == "" {
+		return base
+	}
+	return base + ".." + tip
+}
+
+func revOrHead(rev string) string {
+	if rev == "" {
+		return "HEAD"
+	}
+	return rev
+}
+
+// checkGitRevRange checks that the base and tip of a range are valid commits.
+func checkGitRevRange(base, tip string) bool {
+	return base != "" && checkGitCommit(base) && (tip == "" || checkGitCommit(tip))
+}
+
+// isGitRefName checks whether a revision is a ref name, e.g. "main" or
+// "origin/main", as opposed to a commit hash or a relative revision.
+func isGitRefName(rev string) bool {
+	cmd := exec.Command("git", "rev-parse", "--symbolic-full-name", rev)
+	out, err := cmd.Output()
+	return err == nil && strings.HasPrefix(string(out), "refs/")
+}
+
 func findGitCurrentBranch() string {
 	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
 	b, err := cmd.Output()
@@ -306,16 +792,125 @@ func findGitCurrentBranch() string {
 	return strings.TrimSpace(string(b))
 }
 
-func findGitDefaultBranch() string {
-	// TODO: find a better way to get the default branch
+// findGitBaseBranch detects the branch a feature branch is based on: the
+// configured upstream branch, the remote's default branch, or
+// init.defaultBranch. As a last resort, well-known branch names are tried. An
+// empty string is returned if the base branch is ambiguous.
+func findGitBaseBranch(headBranch string) (string, error) {
+	if v, err := getGitConfig("pyonji.baseBranch"); err != nil || v != "" {
+		return v, err
+	}
+
+	if headBranch != "" && headBranch != "HEAD" {
+		// Skip the upstream if it's the remote copy of the feature branch
+		cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "--symbolic-full-name", headBranch+"@{upstream}")
+		if b, err := cmd.Output(); err == nil {
+			upstream := strings.TrimSpace(string(b))
+			if i := strings.IndexByte(upstream, '/'); upstream != headBranch && (i < 0 || upstream[i+1:] != headBranch) {
+				return upstream, nil
+			}
+		}
+	}
+
+	cmd := exec.Command("git", "symbolic-ref", "--quiet", "--short", "refs/remotes/origin/HEAD")
+	if b, err := cmd.Output(); err == nil {
+		remoteHead := strings.TrimSpace(string(b))
+		// Prefer the local branch, if any
+		if local := strings.TrimPrefix(remoteHead, "origin/"); checkGitBranch(local) {
+			return local, nil
+		}
+		return remoteHead, nil
+	}
+
+	if name, err := getGitConfig("init.defaultBranch"); err != nil {
+		return "", err
+	} else if name != "" && name != headBranch && checkGitBranch(name) {
+		return name, nil
+	}
 
-	for _, name := range []string{"main", "master"} {
-		if checkGitBranch(name) {
-			return name
+	var found []string
+	for _, name := range []string{"main", "master", "develop", "trunk"} {
+		if name != headBranch && checkGitBranch(name) {
+			found = append(found, name)
 		}
 	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	return "", nil
+}
 
-	return ""
+type baseBranchCandidate struct {
+	Name string
+	// Number of commits between the branch and HEAD
+	Distance int
+}
+
+// Maximum number of branches listed as base branch candidates
+const maxBaseBranchCandidates = 50
+
+// listGitBaseBranchCandidates lists the local and remote branches which could
+// be the base of HEAD, closest first.
+func listGitBaseBranchCandidates(ctx context.Context, headBranch string) ([]baseBranchCandidate, error) {
+	cmd := exec.CommandContext(ctx, "git", "for-each-ref", "--sort=-committerdate",
+		fmt.Sprintf("--count=%v", maxBaseBranchCandidates), "--format=%(refname:short)%00%(symref)",
+		"refs/heads", "refs/remotes")
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list branches: %v", err)
+	}
+
+	var candidates []baseBranchCandidate
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		name, symref, _ := strings.Cut(l, "\x00")
+		// Skip symbolic refs such as origin/HEAD
+		if name == "" || name == headBranch || symref != "" {
+			continue
+		}
+		n, err := countGitCommits(ctx, name+"..HEAD")
+		if err != nil {
+			return nil, err
+		} else if n == 0 {
+			continue // no changes to send
+		}
+		candidates = append(candidates, baseBranchCandidate{Name: name, Distance: n})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	return candidates, nil
+}
+
+// checkGitEmptyCommit checks whether a commit has the same tree as its first
+// parent.
+func checkGitEmptyCommit(rev string) bool {
+	cmd := exec.Command("git", "rev-parse", rev+"^{tree}", rev+"^^{tree}")
+	out, err := cmd.Output()
+	if err != nil {
+		return false // e.g. root commit
+	}
+	trees := strings.Fields(string(out))
+	return len(trees) == 2 && trees[0] == trees[1]
+}
+
+func getGitEditor() (string, error) {
+	cmd := exec.Command("git", "var", "GIT_EDITOR")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find editor: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func checkGitAncestor(ancestor, rev string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, rev)
+	return cmd.Run() == nil
+}
+
+func checkGitLocalBranch(name string) bool {
+	cmd := exec.Command("git", "show-ref", "--verify", "--quiet", "refs/heads/"+name)
+	return cmd.Run() == nil
 }
 
 func checkGitBranch(name string) bool {
@@ -331,3 +926,12 @@ func getGitToplevelDir() (string, error) {
 	}
 	return strings.TrimSpace(string(out)), nil
 }
+
+func getGitDir() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--absolute-git-dir")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get Git directory: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -25,14 +25,18 @@ type initModel struct {
 
 	emailInput    textinput.Model
 	passwordInput textinput.Model
+	tokenCmdInput textinput.Model
 	spinner       spinner.Model
 
-	smtpConfig   smtpConfig
-	passwordHint string
-	showPassword bool
-	done         bool
-	loadingMsg   string
-	errMsg       string
+	smtpConfig         smtpConfig
+	passwordHint       string
+	showPassword       bool
+	useOAuth2          bool
+	askPlaintext       bool
+	savedPlaintextPass bool
+	done               bool
+	loadingMsg         string
+	errMsg             string
 }
 
 func initialInitModel(ctx context.Context) initModel {
@@ -52,6 +56,10 @@ func initialInitModel(ctx context.Context) initModel {
 	passwordInput.EchoMode = textinput.EchoPassword
 	passwordInput.EchoCharacter = '•'
 
+	tokenCmdInput := textinput.New()
+	tokenCmdInput.Prompt = "OAuth2 token command: "
+	tokenCmdInput.Placeholder = "oama access me@example.org"
+
 	s := spinner.New()
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
@@ -62,6 +70,7 @@ func initialInitModel(ctx context.Context) initModel {
 
 		emailInput:    emailInput,
 		passwordInput: passwordInput,
+		tokenCmdInput: tokenCmdInput,
 		spinner:       s,
 	}
 }
@@ -74,13 +83,28 @@ func (m initModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.askPlaintext {
+			return m.answerPlaintext(msg)
+		}
 		switch msg.Type {
 		case tea.KeyEnter:
 			if m.emailInput.Focused() {
 				return m.submitEmail()
-			} else if m.passwordInput.Focused() {
+			} else if m.passwordInput.Focused() || m.tokenCmdInput.Focused() {
 				return m.submitPassword()
 			}
+		case tea.KeyTab:
+			if m.showPassword && m.smtpConfig.OAuth2 && !m.smtpConfig.OAuth2Only && m.loadingMsg == "" {
+				m.useOAuth2 = !m.useOAuth2
+				if m.useOAuth2 {
+					m.passwordInput.Blur()
+					m.tokenCmdInput.Focus()
+				} else {
+					m.tokenCmdInput.Blur()
+					m.passwordInput.Focus()
+				}
+				return m, nil
+			}
 		case tea.KeyCtrlC, tea.KeyEsc:
 			return m.quit()
 		}
@@ -92,12 +116,21 @@ func (m initModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.smtpConfig.SMTP = *msg
 		m.showPassword = true
 		m.passwordHint = mailconfig.GetVendorPasswordHint(m.emailInput.Value(), msg.Hostname)
-		m.passwordInput.Focus()
+		if msg.OAuth2Only {
+			m.useOAuth2 = true
+			m.tokenCmdInput.Focus()
+		} else {
+			m.passwordInput.Focus()
+		}
 	case passwordCheckResult:
 		m.loadingMsg = ""
 		if msg.err != nil {
 			m.errMsg = msg.err.Error()
-			m.passwordInput.Focus()
+			if m.useOAuth2 {
+				m.tokenCmdInput.Focus()
+			} else {
+				m.passwordInput.Focus()
+			}
 		} else {
 			if err := saveGitSendEmailConfig(&m.smtpConfig); err != nil {
 				log.Fatal(err)
@@ -107,6 +140,16 @@ func (m initModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					log.Fatal(err)
 				}
 			}
+			if m.useOAuth2 {
+				// No password to remember
+			} else if ok, err := hasGitCredentialHelper(m.smtpConfig.credential()); err != nil {
+				log.Fatal(err)
+			} else if !ok {
+				// The password won't be remembered unless the user
+				// explicitly asks for it to be stored in plaintext
+				m.askPlaintext = true
+				return m, nil
+			}
 			m.done = true
 			return m.quit()
 		}
@@ -118,6 +161,7 @@ func (m initModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	inputs := []*textinput.Model{
 		&m.emailInput,
 		&m.passwordInput,
+		&m.tokenCmdInput,
 	}
 	cmds := make([]tea.Cmd, len(inputs))
 	for i, input := range inputs {
@@ -130,20 +174,39 @@ func (m initModel) View() string {
 	var sb strings.Builder
 	sb.WriteString("This is the first time pyonji is run. Please enter your e-mail account credentials.\n")
 	sb.WriteString(m.emailInput.View() + "\n")
-	if m.showPassword {
+	if m.showPassword && m.useOAuth2 {
+		if m.smtpConfig.OAuth2Only {
+			sb.WriteString("This mail server requires OAuth2. Please enter a command printing an access token.\n")
+		}
+		sb.WriteString(m.tokenCmdInput.View() + "\n")
+	} else if m.showPassword {
 		if m.passwordHint != "" {
 			sb.WriteString(m.passwordHint + "\n")
 		}
 		sb.WriteString(m.passwordInput.View() + "\n")
 	}
+	if m.showPassword && m.smtpConfig.OAuth2 && !m.smtpConfig.OAuth2Only && !m.done {
+		if m.useOAuth2 {
+			sb.WriteString(labelStyle.Render("Press Tab to use a password instead") + "\n")
+		} else {
+			sb.WriteString(labelStyle.Render("Press Tab to use an OAuth2 token command instead") + "\n")
+		}
+	}
 	if m.loadingMsg != "" {
 		sb.WriteString(m.spinner.View() + m.loadingMsg + "\n")
 	}
+	if m.askPlaintext && !m.done {
+		sb.WriteString(warningStyle.Render("⚠ No Git credential helper is configured") + "\n")
+		sb.WriteString("Store the password in plaintext in the global Git config? [y/N] ")
+	}
 	if m.errMsg != "" {
 		sb.WriteString(errorStyle.Render("× "+m.errMsg) + "\n")
 	}
 	if m.done {
 		sb.WriteString(successStyle.Render("✓ Saved mail server settings\n"))
+		if !m.savedPlaintextPass && m.askPlaintext {
+			sb.WriteString("The password will be asked for on the next run. Configure a Git credential helper to remember it.\n")
+		}
 	}
 	return sb.String()
 }
@@ -152,9 +215,28 @@ func (m initModel) quit() (tea.Model, tea.Cmd) {
 	m.loadingMsg = ""
 	m.emailInput.Blur()
 	m.passwordInput.Blur()
+	m.tokenCmdInput.Blur()
 	return m, tea.Quit
 }
 
+func (m initModel) answerPlaintext(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "y", "Y":
+		if err := setGitGlobalConfig("sendemail.smtpPass", m.smtpConfig.Password); err != nil {
+			log.Fatal(err)
+		}
+		m.savedPlaintextPass = true
+	case "n", "N", "enter":
+		// Don't store the password
+	case "ctrl+c", "esc":
+		return m.quit()
+	default:
+		return m, nil
+	}
+	m.done = true
+	return m.quit()
+}
+
 func (m initModel) submitEmail() (tea.Model, tea.Cmd) {
 	addr, err := mail.ParseAddress(m.emailInput.Value())
 	if err != nil {
@@ -176,9 +258,18 @@ func (m initModel) submitEmail() (tea.Model, tea.Cmd) {
 }
 
 func (m initModel) submitPassword() (tea.Model, tea.Cmd) {
-	m.passwordInput.Blur()
-	m.loadingMsg = "Checking password..."
-	m.smtpConfig.Password = m.passwordInput.Value()
+	if m.useOAuth2 {
+		m.tokenCmdInput.Blur()
+		m.loadingMsg = "Checking OAuth2 token..."
+		m.smtpConfig.Password = ""
+		m.smtpConfig.TokenSource = &oauth2TokenSource{Cmd: m.tokenCmdInput.Value()}
+	} else {
+		m.passwordInput.Blur()
+		m.loadingMsg = "Checking password..."
+		m.smtpConfig.Password = m.passwordInput.Value()
+		m.smtpConfig.TokenSource = nil
+		m.smtpConfig.StoreCredential = true
+	}
 
 	return m, func() tea.Msg {
 		err := m.smtpConfig.check(m.ctx)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/mail"
+)
+
+const (
+	// Subjects longer than this are truncated by many tools
+	lintMaxSubjectLen = 72
+	// Mailing lists often reject bigger mails, e.g. vger.kernel.org
+	lintMaxPatchSize = 100 * 1024
+	// Number of commits of the base branch inspected to detect whether the
+	// project uses Signed-off-by trailers
+	lintDCOHistoryLen = 50
+)
+
+// lintSeries checks a series for common mistakes, and returns human-readable
+// warnings.
+func lintSeries(ctx context.Context, baseBranch, tip string, commits []logCommit, patches []patch, from *mail.Address) ([]string, error) {
+	var warnings []string
+	warnCommits := func(format string, l []string) {
+		if len(l) > 0 {
+			warnings = append(warnings, fmt.Sprintf(format, strings.Join(l, ", ")))
+		}
+	}
+
+	usesDCO, err := checkGitHistoryUsesDCO(ctx, baseBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	var noSignOff, longSubject, fixup, otherAuthor, whitespace, crlf []string
+	for _, commit := range commits {
+		name := commit.Hash[:12]
+
+		// The formatted patches may be MIME-encoded (e.g. quoted-printable)
+		// and start with mail headers, so inspect the raw diff instead
+		changes, err := loadGitChanges(ctx, commit.Hash, true)
+		if err != nil {
+			return nil, err
+		}
+		trailingSpace, cr := lintDiff(changes.Diff)
+		if trailingSpace {
+			whitespace = append(whitespace, name)
+		}
+		if cr {
+			crlf = append(crlf, name)
+		}
+
+		if usesDCO && !hasSignOff(commit.Message) {
+			noSignOff = append(noSignOff, name)
+		}
+		if utf8.RuneCountInString(commit.Subject) > lintMaxSubjectLen {
+			longSubject = append(longSubject, name)
+		}
+		for _, prefix := range []string{"fixup!", "squash!", "amend!"} {
+			if strings.HasPrefix(commit.Subject, prefix) {
+				fixup = append(fixup, name)
+				break
+			}
+		}
+		if from != nil && !strings.EqualFold(commit.Author.Address, from.Address) {
+			otherAuthor = append(otherAuthor, name)
+		}
+	}
+	warnCommits("Missing Signed-off-by: %v", noSignOff)
+	warnCommits(fmt.Sprintf("Subject longer than %v characters: %%v", lintMaxSubjectLen), longSubject)
+	warnCommits("Fixup commits should be squashed: %v", fixup)
+	warnCommits("Trailing whitespace added: %v", whitespace)
+	warnCommits("CRLF line endings added: %v", crlf)
+	if from != nil {
+		warnCommits(fmt.Sprintf("Authored with a different address than %v: %%v", from.Address), otherAuthor)
+	}
+
+	merges, err := countGitMerges(ctx, baseBranch+".."+tip)
+	if err != nil {
+		return nil, err
+	} else if merges > 0 {
+		warnings = append(warnings, fmt.Sprintf("The series contains %v, which won't be sent", pluralize("merge commit", merges)))
+	}
+
+	var tooBig []string
+	for _, patch := range patches {
+		if patch.commit != "" && len(patch.Bytes()) > lintMaxPatchSize {
+			tooBig = append(tooBig, patch.commit[:12])
+		}
+	}
+	warnCommits(fmt.Sprintf("Patch bigger than %v KiB, mailing lists may reject it: %%v", lintMaxPatchSize/1024), tooBig)
+
+	stack, err := loadSeriesStack(baseBranch)
+	if err != nil {
+		return nil, err
+	}
+	warnings = append(warnings, stack.lint(tip)...)
+
+	return warnings, nil
+}
+
+func lintFailureWarning(err error) string {
+	return fmt.Sprintf("Failed to check the series for common mistakes: %v", err)
+}
+
+func hasSignOff(msg string) bool {
+	for _, t := range parseTrailers(msg) {
+		if strings.EqualFold(t.Key, "Signed-off-by") {
+			return true
+		}
+	}
+	return false
+}
+
+// lintDiff checks the lines added by a diff for trailing whitespace and
+// carriage returns.
+func lintDiff(diff string) (trailingSpace, cr bool) {
+	for _, l := range strings.Split(diff, "\n") {
+		if !strings.HasPrefix(l, "+") || strings.HasPrefix(l, "+++ ") {
+			continue
+		}
+		if strings.HasSuffix(l, "\r") {
+			cr = true
+			l = strings.TrimSuffix(l, "\r")
+		}
+		if len(l) > 1 && strings.TrimRight(l, " \t") != l {
+			trailingSpace = true
+		}
+	}
+	return trailingSpace, cr
+}
+
+// checkGitHistoryUsesDCO returns true if most recent commits of a branch have
+// a Signed-off-by trailer.
+func checkGitHistoryUsesDCO(ctx context.Context, branch string) (bool, error) {
+	log, err := loadGitLog(ctx, fmt.Sprintf("--max-count=%v", lintDCOHistoryLen), branch)
+	if err != nil {
+		return false, err
+	}
+	n := 0
+	for _, commit := range log {
+		if hasSignOff(commit.Message) {
+			n++
+		}
+	}
+	return len(log) > 0 && n*2 > len(log), nil
+}
+
+func countGitMerges(ctx context.Context, revRange string) (int, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-list", "--count", "--merges", revRange)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count merge commits: %v", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestLintDiff(t *testing.T) {
+	tests := []struct {
+		name              string
+		diff              string
+		trailingSpace, cr bool
+	}{
+		{
+			name: "clean",
+			diff: "--- a/foo\n+++ b/foo\n@@ -1 +1 @@\n-old\n+new\n",
+		},
+		{
+			name:          "trailing space",
+			diff:          "--- a/foo\n+++ b/foo\n@@ -1 +1 @@\n-old\n+new \n",
+			trailingSpace: true,
+		},
+		{
+			name:          "trailing tab",
+			diff:          "+new\t\n",
+			trailingSpace: true,
+		},
+		{
+			name: "removed line",
+			diff: "-old \n+new\n",
+		},
+		{
+			name: "context line",
+			diff: " old \n+new\n",
+		},
+		{
+			name: "added empty line",
+			diff: "+\n",
+		},
+		{
+			name: "CRLF",
+			diff: "+new\r\n",
+			cr:   true,
+		},
+		{
+			name:          "CRLF and trailing space",
+			diff:          "+new \r\n",
+			trailingSpace: true,
+			cr:            true,
+		},
+		{
+			name: "file header",
+			diff: "+++ b/foo \n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trailingSpace, cr := lintDiff(tc.diff)
+			if trailingSpace != tc.trailingSpace || cr != tc.cr {
+				t.Errorf("lintDiff() = %v, %v, want %v, %v", trailingSpace, cr, tc.trailingSpace, tc.cr)
+			}
+		})
+	}
+}
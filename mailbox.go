@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-mbox"
+)
+
+// openMailbox opens a mailSender which writes mails to a local mailbox
+// instead of sending them. If path is a directory or ends with a slash, a
+// Maildir is used, otherwise an mbox file is used.
+func openMailbox(path string) (mailSender, error) {
+	if fi, err := os.Stat(path); (err == nil && fi.IsDir()) || strings.HasSuffix(path, "/") {
+		return openMaildir(path)
+	}
+	return createMbox(path)
+}
+
+type mboxFile struct {
+	f  *os.File
+	mw *mbox.Writer
+}
+
+var _ mailSender = (*mboxFile)(nil)
+
+func createMbox(path string) (*mboxFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mbox: %v", err)
+	}
+	return &mboxFile{f: f, mw: mbox.NewWriter(f)}, nil
+}
+
+func (mf *mboxFile) Close() error {
+	if err := mf.mw.Close(); err != nil {
+		mf.f.Close()
+		return fmt.Errorf("failed to write mbox: %v", err)
+	}
+	return mf.f.Close()
+}
+
+func (mf *mboxFile) SendMail(ctx context.Context, from string, to []string, data io.Reader) error {
+	w, err := mf.mw.CreateMessage(from, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to write mbox: %v", err)
+	}
+	if _, err := io.Copy(w, data); err != nil {
+		return fmt.Errorf("failed to write mbox: %v", err)
+	}
+	return nil
+}
+
+type maildir struct {
+	dir string
+}
+
+var _ mailSender = (*maildir)(nil)
+
+func openMaildir(dir string) (*maildir, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create Maildir: %v", err)
+		}
+	}
+	return &maildir{dir}, nil
+}
+
+func (md *maildir) Close() error {
+	return nil
+}
+
+var maildirCounter uint64
+
+func (md *maildir) SendMail(ctx context.Context, from string, to []string, data io.Reader) error {
+	hostname, _ := os.Hostname()
+	n := atomic.AddUint64(&maildirCounter, 1)
+	name := fmt.Sprintf("%v.P%vQ%v.%v", time.Now().Unix(), os.Getpid(), n, strings.ReplaceAll(hostname, "/", "_"))
+
+	// Deliver to tmp first, then move to new, as described in maildir(5)
+	tmpPath := filepath.Join(md.dir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to Maildir: %v", err)
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write to Maildir: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write to Maildir: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(md.dir, "new", name)); err != nil {
+		return fmt.Errorf("failed to write to Maildir: %v", err)
+	}
+	return nil
+}
@@ -15,6 +15,11 @@ type SMTP struct {
 	StartTLS bool
 
 	Username string
+
+	// OAuth2 is set if the server supports OAuth2 authentication
+	OAuth2 bool
+	// OAuth2Only is set if the server doesn't support password authentication
+	OAuth2Only bool
 }
 
 type provider interface {
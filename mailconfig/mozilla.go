@@ -38,6 +38,7 @@ type mozillaAuth string
 
 const (
 	mozillaAuthPasswordCleartext mozillaAuth = "password-cleartext"
+	mozillaAuthOAuth2            mozillaAuth = "OAuth2"
 )
 
 func discoverMozilla(ctx context.Context, addr, url string) (*SMTP, error) {
@@ -65,26 +66,32 @@ func discoverMozilla(ctx context.Context, addr, url string) (*SMTP, error) {
 		return nil, err
 	}
 
-	var startTLSCfg *SMTP
+	// Servers supporting passwords are preferred, OAuth2-only ones are only
+	// used as a fallback
+	var startTLSCfg, oauth2SSLCfg, oauth2StartTLSCfg *SMTP
 	for _, srv := range data.EmailProvider.OutgoingServer {
 		if srv.Type != "smtp" {
 			continue
 		}
 
-		authSupported := false
+		passwordSupported, oauth2Supported := false, false
 		for _, auth := range srv.Auth {
-			if auth == mozillaAuthPasswordCleartext {
-				authSupported = true
-				break
+			switch auth {
+			case mozillaAuthPasswordCleartext:
+				passwordSupported = true
+			case mozillaAuthOAuth2:
+				oauth2Supported = true
 			}
 		}
-		if !authSupported {
+		if !passwordSupported && !oauth2Supported {
 			continue
 		}
 
 		cfg := &SMTP{
-			Hostname: srv.Hostname,
-			Port:     fmt.Sprintf("%v", srv.Port),
+			Hostname:   srv.Hostname,
+			Port:       fmt.Sprintf("%v", srv.Port),
+			OAuth2:     oauth2Supported,
+			OAuth2Only: !passwordSupported,
 		}
 
 		// See https://wiki.mozilla.org/Thunderbird:Autoconfiguration:ConfigFileFormat#Placeholders
@@ -100,16 +107,26 @@ func discoverMozilla(ctx context.Context, addr, url string) (*SMTP, error) {
 
 		switch srv.SocketType {
 		case mozillaSocketSSL:
-			return cfg, nil
+			if !cfg.OAuth2Only {
+				return cfg, nil
+			} else if oauth2SSLCfg == nil {
+				oauth2SSLCfg = cfg
+			}
 		case mozillaSocketSTARTTLS:
 			cfg.StartTLS = true
-			startTLSCfg = cfg
+			if !cfg.OAuth2Only {
+				startTLSCfg = cfg
+			} else {
+				oauth2StartTLSCfg = cfg
+			}
 		default:
 			continue
 		}
 	}
-	if startTLSCfg != nil {
-		return startTLSCfg, nil
+	for _, cfg := range []*SMTP{startTLSCfg, oauth2SSLCfg, oauth2StartTLSCfg} {
+		if cfg != nil {
+			return cfg, nil
+		}
 	}
 
 	return nil, ErrNotFound
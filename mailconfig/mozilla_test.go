@@ -0,0 +1,74 @@
+package mailconfig
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiscoverMozilla(t *testing.T) {
+	server := func(hostname, socketType, auth string) string {
+		return fmt.Sprintf(`<outgoingServer type="smtp">
+	<hostname>%v</hostname>
+	<port>465</port>
+	<socketType>%v</socketType>
+	<username>%%EMAILADDRESS%%</username>
+	<authentication>%v</authentication>
+</outgoingServer>`, hostname, socketType, auth)
+	}
+
+	tests := []struct {
+		name       string
+		servers    []string
+		hostname   string
+		oauth2Only bool
+	}{
+		{
+			name:     "SSL preferred",
+			servers:  []string{server("starttls", "STARTTLS", "password-cleartext"), server("ssl", "SSL", "password-cleartext")},
+			hostname: "ssl",
+		},
+		{
+			name:     "password preferred",
+			servers:  []string{server("oauth2", "SSL", "OAuth2"), server("password", "STARTTLS", "password-cleartext")},
+			hostname: "password",
+		},
+		{
+			name:       "OAuth2 fallback",
+			servers:    []string{server("oauth2-starttls", "STARTTLS", "OAuth2"), server("oauth2-ssl", "SSL", "OAuth2")},
+			hostname:   "oauth2-ssl",
+			oauth2Only: true,
+		},
+		{
+			name:    "unsupported",
+			servers: []string{server("gssapi", "SSL", "GSSAPI")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `<clientConfig version="1.1"><emailProvider id="example.org">`)
+				for _, s := range tc.servers {
+					fmt.Fprint(w, s)
+				}
+				fmt.Fprint(w, `</emailProvider></clientConfig>`)
+			}))
+			defer ts.Close()
+
+			cfg, err := discoverMozilla(context.Background(), "me@example.org", ts.URL)
+			if tc.hostname == "" {
+				if err != ErrNotFound {
+					t.Errorf("discoverMozilla() = %v, %v, want ErrNotFound", cfg, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("discoverMozilla() = %v", err)
+			}
+			if cfg.Hostname != tc.hostname || cfg.OAuth2Only != tc.oauth2Only {
+				t.Errorf("discoverMozilla() = %v (OAuth2-only: %v), want %v (OAuth2-only: %v)", cfg.Hostname, cfg.OAuth2Only, tc.hostname, tc.oauth2Only)
+			}
+		})
+	}
+}
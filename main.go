@@ -3,34 +3,88 @@ package main
 import (
 	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/pborman/getopt/v2"
 )
 
 func main() {
+	var flags submitFlags
+	getopt.FlagLong(&flags.identity, "identity", 0, "sendemail identity to use")
+	getopt.FlagLong(&flags.baseBranch, "base", 0, "base branch, or range of commits to send (e.g. HEAD~3..HEAD)")
+	getopt.FlagLong(&flags.to, "to", 0, "recipient")
+	getopt.FlagLong(&flags.cc, "cc", 0, "carbon copy recipient")
+	getopt.FlagLong(&flags.rerollCount, "reroll-count", 'v', "iteration number")
+	getopt.FlagLong(&flags.inReplyTo, "in-reply-to", 0, "Message-ID to reply to")
+	getopt.FlagLong(&flags.changeID, "change-id", 0, "attach the current branch to an existing series")
+	getopt.FlagLong(&flags.resume, "resume", 0, "resume an interrupted submission")
+	getopt.FlagLong(&flags.batch, "batch", 0, "send without user interaction and print a JSON report")
+	getopt.FlagLong(&flags.dryRun, "dry-run", 0, "save mails to a local mailbox instead of sending them")
+	getopt.FlagLong(&flags.output, "output", 'o', "mbox file or Maildir directory for --dry-run and saved mails", "path")
+	getopt.FlagLong(&flags.noValidate, "no-validate", 0, "don't run the sendemail-validate hook and other checks")
+	getopt.Parse()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	gitConfig, err := loadGitSendEmailConfig()
+	identity, err := loadSendEmailIdentity(findGitCurrentBranch(), flags.changeID, flags.identity)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	if gitConfig == nil {
-		p := tea.NewProgram(initialInitModel(ctx))
-		if m, err := p.Run(); err != nil {
+	if flags.resume {
+		// Resume with the identity the submission has been started with
+		if ob, err := loadOutbox(); err != nil {
 			log.Fatal(err)
-		} else {
-			m := m.(initModel)
-			if !m.done {
-				return
+		} else if ob != nil {
+			identity = ob.Identity
+		}
+	}
+	gitConfig, err := loadGitSendEmailConfig(identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flags.batch {
+		// Abort cleanly on Ctrl-C, reporting which messages have been sent
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		code := runBatch(ctx, gitConfig, &flags)
+		stop()
+		cancel()
+		os.Exit(code)
+	}
+
+	if flags.dryRun && flags.resume {
+		log.Fatal("--dry-run and --resume are mutually exclusive: interrupted submissions can only be resumed by sending them")
+	}
+
+	// No mail server is needed to save mails locally in dry-run mode
+	if !flags.dryRun {
+		if gitConfig == nil {
+			p := tea.NewProgram(initialInitModel(ctx))
+			if m, err := p.Run(); err != nil {
+				log.Fatal(err)
+			} else {
+				m := m.(initModel)
+				if !m.done {
+					return
+				}
+				gitConfig = &gitSendEmailConfig{SMTP: &m.smtpConfig}
+			}
+		}
+
+		// Servers which don't require authentication have no smtpUser
+		if smtpConfig := gitConfig.SMTP; smtpConfig != nil && smtpConfig.needsPassword() {
+			if err := smtpConfig.fillCredential(true); err != nil {
+				log.Fatal(err)
 			}
-			gitConfig = &gitSendEmailConfig{SMTP: &m.smtpConfig}
 		}
 	}
 
-	p := tea.NewProgram(initialSubmitModel(ctx, gitConfig))
+	p := tea.NewProgram(initialSubmitModel(ctx, gitConfig, &flags))
 	if _, err := p.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// maintainersSection is an entry of a Linux-style MAINTAINERS file.
+type maintainersSection struct {
+	Name        string
+	Maintainers []*mail.Address // M:
+	Reviewers   []*mail.Address // R:
+	Lists       []*mail.Address // L:
+	Files       []string        // F:
+	Excludes    []string        // X:
+	FileRegexps []*regexp.Regexp
+	Keywords    []*regexp.Regexp
+}
+
+var maintainersEntryRegexp = regexp.MustCompile(`^([A-Z]):\s*(.*)$`)
+
+// loadMaintainers parses the MAINTAINERS file at the root of the repository.
+// nil is returned if there is none. Invalid entries are skipped, and reported
+// as warnings.
+func loadMaintainers() ([]maintainersSection, []string, error) {
+	toplevelDir, err := getGitToplevelDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(toplevelDir, "MAINTAINERS"))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to open MAINTAINERS: %v", err)
+	}
+	defer f.Close()
+
+	sections, warnings, err := parseMaintainers(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse MAINTAINERS: %v", err)
+	}
+	return sections, warnings, nil
+}
+
+func parseMaintainers(r io.Reader) ([]maintainersSection, []string, error) {
+	var (
+		sections []maintainersSection
+		warnings []string
+		cur      *maintainersSection
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), " \t")
+		if l == "" {
+			cur = nil
+			continue
+		}
+
+		m := maintainersEntryRegexp.FindStringSubmatch(l)
+		if m == nil {
+			// Sections start with a title after a blank line
+			if cur == nil {
+				sections = append(sections, maintainersSection{Name: strings.TrimSpace(l)})
+				cur = &sections[len(sections)-1]
+			}
+			continue
+		} else if cur == nil {
+			// Entry outside of any section, e.g. in the introduction
+			continue
+		}
+
+		k, v := m[1], m[2]
+		switch k {
+		case "M", "R", "L":
+			// Lists may be followed by a comment, e.g. "(moderated for
+			// non-subscribers)"
+			if k == "L" {
+				v, _, _ = strings.Cut(v, " (")
+			}
+			addr, err := mail.ParseAddress(v)
+			if err != nil {
+				continue // e.g. "M: Odd fixes"
+			}
+			switch k {
+			case "M":
+				cur.Maintainers = append(cur.Maintainers, addr)
+			case "R":
+				cur.Reviewers = append(cur.Reviewers, addr)
+			case "L":
+				cur.Lists = append(cur.Lists, addr)
+			}
+		case "F":
+			cur.Files = append(cur.Files, v)
+		case "X":
+			cur.Excludes = append(cur.Excludes, v)
+		case "N", "K":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("MAINTAINERS section %q: ignoring invalid %v: pattern: %v", cur.Name, k, err))
+				continue
+			}
+			if k == "N" {
+				cur.FileRegexps = append(cur.FileRegexps, re)
+			} else {
+				cur.Keywords = append(cur.Keywords, re)
+			}
+		}
+	}
+	return sections, warnings, sc.Err()
+}
+
+// matchMaintainersPattern checks whether a file matches an F: or X: pattern.
+// Patterns ending with a slash, or without wildcards, match a whole
+// directory.
+func matchMaintainersPattern(pattern, filename string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, filename)
+		return ok
+	}
+	dir := strings.TrimSuffix(pattern, "/")
+	return filename == dir || strings.HasPrefix(filename, dir+"/")
+}
+
+func (s *maintainersSection) matchFile(filename string) bool {
+	for _, pattern := range s.Excludes {
+		if matchMaintainersPattern(pattern, filename) {
+			return false
+		}
+	}
+	for _, pattern := range s.Files {
+		if matchMaintainersPattern(pattern, filename) {
+			return true
+		}
+	}
+	for _, re := range s.FileRegexps {
+		if re.MatchString(filename) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *maintainersSection) match(changes *gitChanges) bool {
+	for _, filename := range changes.Files {
+		if s.matchFile(filename) {
+			return true
+		}
+	}
+	for _, re := range s.Keywords {
+		if re.MatchString(changes.Diff) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMaintainersKeywords(sections []maintainersSection) bool {
+	for _, s := range sections {
+		if len(s.Keywords) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMaintainers returns the sections responsible for a set of changes.
+func matchMaintainers(sections []maintainersSection, changes *gitChanges) []*maintainersSection {
+	var l []*maintainersSection
+	for i := range sections {
+		s := &sections[i]
+		if len(s.Maintainers) == 0 && len(s.Reviewers) == 0 && len(s.Lists) == 0 {
+			continue
+		}
+		if s.match(changes) {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+// maintainersRecipients returns the mailing lists and the maintainers and
+// reviewers of a set of sections.
+func maintainersRecipients(sections []*maintainersSection) (lists, people []*mail.Address) {
+	for _, s := range sections {
+		lists = appendAddressUnique(lists, s.Lists...)
+		people = appendAddressUnique(people, s.Maintainers...)
+		people = appendAddressUnique(people, s.Reviewers...)
+	}
+	return lists, people
+}
+
+func formatMaintainersSections(sections []*maintainersSection) string {
+	names := make([]string, len(sections))
+	for i, s := range sections {
+		names[i] = s.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+type maintainersMode string
+
+const (
+	// Maintainers of the whole series are suggested in the To and Cc fields
+	maintainersModeSeries maintainersMode = "series"
+	// Maintainers are only Cc'ed on the patches touching their files
+	maintainersModePatch maintainersMode = "patch"
+	maintainersModeNone  maintainersMode = "none"
+)
+
+func loadMaintainersMode() (maintainersMode, error) {
+	v, err := getGitConfig("pyonji.maintainers")
+	if err != nil {
+		return "", err
+	}
+	switch mode := maintainersMode(v); mode {
+	case "":
+		return maintainersModeSeries, nil
+	case maintainersModeSeries, maintainersModePatch, maintainersModeNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid pyonji.maintainers %q", v)
+	}
+}
+
+// gitChanges describes the files touched by a commit or range of commits.
+type gitChanges struct {
+	Files []string
+	Diff  string // only populated if needed
+}
+
+// loadGitChanges loads the changes of a commit, or of a range of commits if
+// rev is "<base>...<head>".
+func loadGitChanges(ctx context.Context, rev string, withDiff bool) (*gitChanges, error) {
+	var args []string
+	if strings.Contains(rev, "...") {
+		args = []string{"diff", rev}
+	} else {
+		args = []string{"show", "--format=", rev}
+	}
+
+	cmd := exec.CommandContext(ctx, "git", append(args, "--name-only", "--no-renames")...)
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed files: %v", err)
+	}
+
+	var changes gitChanges
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			changes.Files = append(changes.Files, l)
+		}
+	}
+
+	if withDiff {
+		cmd := exec.CommandContext(ctx, "git", append(args, "--no-color")...)
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load diff: %v", err)
+		}
+		changes.Diff = string(b)
+	}
+
+	return &changes, nil
+}
+
+// maintainersSuggestions computes the MAINTAINERS sections of a series and of
+// its commits.
+type maintainersSuggestions struct {
+	mode     maintainersMode
+	sections []maintainersSection
+	warnings []string
+}
+
+func loadMaintainersSuggestions() (*maintainersSuggestions, error) {
+	mode, err := loadMaintainersMode()
+	if err != nil || mode == maintainersModeNone {
+		return nil, err
+	}
+	sections, warnings, err := loadMaintainers()
+	if err != nil || sections == nil {
+		return nil, err
+	}
+	return &maintainersSuggestions{mode: mode, sections: sections, warnings: warnings}, nil
+}
+
+func (ms *maintainersSuggestions) match(ctx context.Context, rev string) ([]*maintainersSection, error) {
+	changes, err := loadGitChanges(ctx, rev, hasMaintainersKeywords(ms.sections))
+	if err != nil {
+		return nil, err
+	}
+	return matchMaintainers(ms.sections, changes), nil
+}
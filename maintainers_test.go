@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMaintainers = `M: Not in a section <intro@example.org>
+
+FOO DRIVER
+M:	Joe Doe <joe@example.org>
+R:	Jane Doe <jane@example.org>
+L:	foo@lists.example.org (moderated for non-subscribers)
+S:	Maintained
+F:	drivers/foo/
+X:	drivers/foo/bar.c
+N:	foo
+K:	\bfoo_[a-z]+\b
+
+BAR DRIVER
+M:	Odd fixes
+F:	drivers/bar/*.c
+N:	[bad
+`
+
+func TestParseMaintainers(t *testing.T) {
+	sections, warnings, err := parseMaintainers(strings.NewReader(testMaintainers))
+	if err != nil {
+		t.Fatalf("parseMaintainers() = %v", err)
+	}
+
+	var names []string
+	for _, section := range sections {
+		names = append(names, section.Name)
+	}
+	wantNames := []string{"FOO DRIVER", "BAR DRIVER"}
+	if strings.Join(names, "|") != strings.Join(wantNames, "|") {
+		t.Fatalf("parseMaintainers() sections = %q, want %q", names, wantNames)
+	}
+
+	foo := sections[0]
+	tests := []struct {
+		field     string
+		got, want string
+	}{
+		{"M", formatAddressList(foo.Maintainers), "Joe Doe <joe@example.org>"},
+		{"R", formatAddressList(foo.Reviewers), "Jane Doe <jane@example.org>"},
+		{"L", formatAddressList(foo.Lists), "foo@lists.example.org"},
+		{"F", strings.Join(foo.Files, " "), "drivers/foo/"},
+		{"X", strings.Join(foo.Excludes, " "), "drivers/foo/bar.c"},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("FOO DRIVER %v: = %q, want %q", tc.field, tc.got, tc.want)
+		}
+	}
+	if len(foo.FileRegexps) != 1 || len(foo.Keywords) != 1 {
+		t.Errorf("FOO DRIVER: got %v N: and %v K: patterns, want 1 and 1", len(foo.FileRegexps), len(foo.Keywords))
+	}
+
+	bar := sections[1]
+	if len(bar.Maintainers) != 0 {
+		t.Errorf("BAR DRIVER: got %v maintainers, want none", len(bar.Maintainers))
+	}
+	if len(bar.FileRegexps) != 0 || len(warnings) != 1 {
+		t.Errorf("BAR DRIVER: invalid N: pattern not skipped with a warning: %q", warnings)
+	}
+}
+
+func TestMatchMaintainersPattern(t *testing.T) {
+	tests := []struct {
+		pattern, filename string
+		want              bool
+	}{
+		{"drivers/foo/", "drivers/foo/foo.c", true},
+		{"drivers/foo/", "drivers/foo/sub/foo.c", true},
+		{"drivers/foo/", "drivers/foobar/foo.c", false},
+		{"drivers/foo", "drivers/foo/foo.c", true},
+		{"drivers/foo/foo.c", "drivers/foo/foo.c", true},
+		{"drivers/foo/*.c", "drivers/foo/foo.c", true},
+		{"drivers/foo/*.c", "drivers/foo/foo.h", false},
+	}
+	for _, tc := range tests {
+		if got := matchMaintainersPattern(tc.pattern, tc.filename); got != tc.want {
+			t.Errorf("matchMaintainersPattern(%q, %q) = %v, want %v", tc.pattern, tc.filename, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// oauth2TokenSource describes how to obtain OAuth2 access tokens. Either a
+// command printing an access token is used, or a refresh token (stored like a
+// password) is exchanged for an access token at the token endpoint.
+type oauth2TokenSource struct {
+	Cmd          string
+	URL          string
+	ClientID     string
+	ClientSecret string
+}
+
+func loadOAuth2TokenSource(identity string) (*oauth2TokenSource, error) {
+	var src oauth2TokenSource
+	entries := map[string]*string{
+		"smtpOAuthTokenCmd":     &src.Cmd,
+		"smtpOAuthTokenURL":     &src.URL,
+		"smtpOAuthClientID":     &src.ClientID,
+		"smtpOAuthClientSecret": &src.ClientSecret,
+	}
+	for k, ptr := range entries {
+		v, err := getSendEmailConfig(identity, k)
+		if err != nil {
+			return nil, err
+		}
+		*ptr = v
+	}
+
+	if src.Cmd == "" && src.URL == "" {
+		return nil, nil
+	} else if src.Cmd != "" && src.URL != "" {
+		return nil, fmt.Errorf("conflicting Git sendemail options: smtpOAuthTokenCmd and smtpOAuthTokenURL")
+	} else if src.URL != "" && src.ClientID == "" {
+		return nil, fmt.Errorf("missing sendemail.smtpOAuthClientID in the Git configuration")
+	}
+	return &src, nil
+}
+
+// usesRefreshToken returns true if the token source needs a refresh token.
+func (src *oauth2TokenSource) usesRefreshToken() bool {
+	return src.Cmd == ""
+}
+
+func (src *oauth2TokenSource) runCmd(ctx context.Context) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", src.Cmd)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("OAuth2 token command failed: %v: %v", err, msg)
+		}
+		return "", fmt.Errorf("OAuth2 token command failed: %v", err)
+	}
+
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("OAuth2 token command didn't print any token")
+	}
+	return token, nil
+}
+
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oauth2GrantError is returned by the token endpoint when the refresh token
+// is invalid, expired or revoked.
+type oauth2GrantError struct {
+	description string
+}
+
+func (err *oauth2GrantError) Error() string {
+	if err.description == "" {
+		return "OAuth2 refresh token rejected"
+	}
+	return fmt.Sprintf("OAuth2 refresh token rejected: %v", err.description)
+}
+
+// refresh exchanges a refresh token for an access token, see RFC 6749 section
+// 6. The token endpoint may issue a new refresh token, in which case it's
+// returned as well.
+func (src *oauth2TokenSource) refresh(ctx context.Context, refreshToken string) (accessToken, newRefreshToken string, err error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {src.ClientID},
+	}
+	if src.ClientSecret != "" {
+		form.Set("client_secret", src.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, src.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to refresh OAuth2 token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var data oauth2TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", "", fmt.Errorf("failed to refresh OAuth2 token: HTTP error: %v", resp.Status)
+	}
+	if data.Error == "invalid_grant" {
+		return "", "", &oauth2GrantError{data.ErrorDescription}
+	} else if data.Error != "" {
+		return "", "", fmt.Errorf("failed to refresh OAuth2 token: %v (%v)", data.Error, data.ErrorDescription)
+	} else if resp.StatusCode != http.StatusOK || data.AccessToken == "" {
+		return "", "", fmt.Errorf("failed to refresh OAuth2 token: HTTP error: %v", resp.Status)
+	}
+	return data.AccessToken, data.RefreshToken, nil
+}
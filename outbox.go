@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// outbox holds the messages of a submission. It's saved on-disk before any
+// message is sent, so that an interrupted submission can be resumed without
+// sending the same messages twice.
+type outbox struct {
+	dir string
+	outboxState
+}
+
+type outboxState struct {
+	Branch   string          `json:"branch"`
+	Identity string          `json:"identity,omitempty"`
+	Base     string          `json:"base"`
+	Commit   string          `json:"commit"`
+	Version  string          `json:"version"`
+	Messages []outboxMessage `json:"messages"`
+}
+
+type outboxMessage struct {
+	Filename  string   `json:"filename"`
+	MessageID string   `json:"message_id"`
+	Subject   string   `json:"subject"`
+	From      string   `json:"from"`
+	To        []string `json:"to"`
+	Sent      bool     `json:"sent"`
+}
+
+func getOutboxDir() (string, error) {
+	gitDir, err := getGitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gitDir, "pyonji", "outbox"), nil
+}
+
+// createOutbox writes a new outbox to disk, replacing any previous one.
+func createOutbox(state *outboxState, patches []patch) (*outbox, error) {
+	dir, err := getOutboxDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to remove previous outbox: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox: %v", err)
+	}
+
+	for i, patch := range patches {
+		msg := &state.Messages[i]
+		msg.Filename = fmt.Sprintf("%04d.eml", i+1)
+		if err := os.WriteFile(filepath.Join(dir, msg.Filename), patch.Bytes(), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write outbox message: %v", err)
+		}
+	}
+
+	ob := &outbox{dir: dir, outboxState: *state}
+	if err := ob.save(); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// loadOutbox loads the outbox left behind by an interrupted submission. It
+// returns nil if there is none.
+func loadOutbox() (*outbox, error) {
+	dir, err := getOutboxDir()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %v", err)
+	}
+
+	ob := &outbox{dir: dir}
+	if err := json.Unmarshal(b, &ob.outboxState); err != nil {
+		return nil, fmt.Errorf("failed to parse outbox: %v", err)
+	}
+	return ob, nil
+}
+
+// loadSendEmailConfig loads the sendemail config of the identity the outbox
+// has been created with. gitConfig is the config of the identity in use, it's
+// returned as-is if the identities match.
+func (ob *outbox) loadSendEmailConfig(identity string, gitConfig *gitSendEmailConfig) (*gitSendEmailConfig, error) {
+	if ob.Identity == identity {
+		return gitConfig, nil
+	}
+
+	obConfig, err := loadGitSendEmailConfig(ob.Identity)
+	if err != nil {
+		return nil, err
+	} else if obConfig == nil {
+		// Keep using the mail server set up on first run
+		return gitConfig, nil
+	}
+	if smtpConfig := obConfig.SMTP; smtpConfig != nil && smtpConfig.needsPassword() {
+		if err := smtpConfig.fillCredential(false); err != nil {
+			return nil, fmt.Errorf("failed to get password for identity %q (run pyonji --identity %v to enter it): %v", ob.Identity, ob.Identity, err)
+		}
+	}
+	return obConfig, nil
+}
+
+func (ob *outbox) save() error {
+	b, err := json.MarshalIndent(&ob.outboxState, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, to avoid corrupting the state if
+	// we're interrupted
+	tmpPath := filepath.Join(ob.dir, "state.json.tmp")
+	if err := os.WriteFile(tmpPath, b, 0600); err != nil {
+		return fmt.Errorf("failed to write outbox: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(ob.dir, "state.json")); err != nil {
+		return fmt.Errorf("failed to write outbox: %v", err)
+	}
+	return nil
+}
+
+func (ob *outbox) remove() error {
+	if err := os.RemoveAll(ob.dir); err != nil {
+		return fmt.Errorf("failed to remove outbox: %v", err)
+	}
+	return nil
+}
+
+func (ob *outbox) sentCount() int {
+	n := 0
+	for _, msg := range ob.Messages {
+		if msg.Sent {
+			n++
+		}
+	}
+	return n
+}
+
+// sendOutbox sends all messages which haven't been sent yet.
+func sendOutbox(ctx context.Context, ob *outbox, git *gitSendEmailConfig, ch chan<- submissionProgress) tea.Msg {
+	var (
+		sender mailSender
+		err    error
+	)
+	if git.SMTP != nil {
+		sender, err = git.SMTP.dialAndAuth(ctx)
+	} else {
+		sender = &sendmailCmd{git.Sendmail}
+	}
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+
+	progress := submissionProgress{mailsSent: ob.sentCount(), mailsTotal: len(ob.Messages)}
+	ch <- progress
+
+	for i := range ob.Messages {
+		msg := &ob.Messages[i]
+		if msg.Sent {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		b, err := os.ReadFile(filepath.Join(ob.dir, msg.Filename))
+		if err != nil {
+			return fmt.Errorf("failed to read outbox message: %v", err)
+		}
+
+		if err := sender.SendMail(ctx, msg.From, msg.To, bytes.NewReader(b)); err != nil {
+			if ctx.Err() != nil {
+				// The error is a consequence of the cancellation
+				return ctx.Err()
+			}
+			return err
+		}
+
+		msg.Sent = true
+		if err := ob.save(); err != nil {
+			return err
+		}
+
+		progress.mailsSent++
+		ch <- progress
+	}
+
+	warnings, err := finishSubmission(&ob.outboxState)
+	if err != nil {
+		return err
+	}
+	if err := ob.remove(); err != nil {
+		return err
+	}
+
+	progress.done = true
+	progress.warnings = warnings
+	return progress
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	diffHeaderStyle = lipgloss.NewStyle().Bold(true)
+	diffHunkStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	diffAddStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	diffDelStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+)
+
+type patchPreview struct {
+	title   string
+	content string
+}
+
+// renderPatchPreview renders a mail as it will be sent, with a colored diff.
+func renderPatchPreview(p *patch) string {
+	var sb strings.Builder
+
+	fields := p.header.Fields()
+	for fields.Next() {
+		v, err := fields.Text()
+		if err != nil {
+			v = fields.Value()
+		}
+		sb.WriteString(labelStyle.Render(fields.Key()+":") + " " + v + "\n")
+	}
+	sb.WriteString("\n")
+
+	inDiff := false
+	body := strings.ReplaceAll(string(p.body), "\r\n", "\n")
+	for _, l := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(l, "diff --git ") {
+			inDiff = true
+		} else if l == "-- " {
+			// Signature
+			inDiff = false
+		}
+
+		switch {
+		case !inDiff:
+			// Commit message and diffstat
+		case strings.HasPrefix(l, "diff --git "), strings.HasPrefix(l, "index "), strings.HasPrefix(l, "--- "), strings.HasPrefix(l, "+++ "):
+			l = diffHeaderStyle.Render(l)
+		case strings.HasPrefix(l, "@@"):
+			l = diffHunkStyle.Render(l)
+		case strings.HasPrefix(l, "+"):
+			l = diffAddStyle.Render(l)
+		case strings.HasPrefix(l, "-"):
+			l = diffDelStyle.Render(l)
+		}
+		sb.WriteString(l + "\n")
+	}
+
+	return sb.String()
+}
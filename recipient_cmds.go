@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// recipientCmds holds the git-send-email commands printing recipients and
+// headers for a patch.
+type recipientCmds struct {
+	ToCmd     string
+	CcCmd     string
+	HeaderCmd string
+
+	// b4 send-auto-to-cmd and send-auto-cc-cmd, used if the git-send-email
+	// ones are unset
+	AutoToCmd string
+	AutoCcCmd string
+}
+
+type headerField struct {
+	Key, Value string
+}
+
+// recipientCmdsResult is the output of the recipient commands for a patch.
+type recipientCmdsResult struct {
+	To     []*mail.Address
+	Cc     []*mail.Address
+	Header []headerField
+}
+
+// loadRecipientCmds loads sendemail.toCmd, ccCmd and headerCmd, and the b4
+// equivalents. nil is returned if none is set.
+func loadRecipientCmds(identity string) (*recipientCmds, error) {
+	var cmds recipientCmds
+	entries := map[string]*string{
+		"toCmd":     &cmds.ToCmd,
+		"ccCmd":     &cmds.CcCmd,
+		"headerCmd": &cmds.HeaderCmd,
+	}
+	for k, ptr := range entries {
+		v, err := getSendEmailConfig(identity, k)
+		if err != nil {
+			return nil, err
+		}
+		*ptr = v
+	}
+	b4Entries := map[string]*string{
+		"send-auto-to-cmd": &cmds.AutoToCmd,
+		"send-auto-cc-cmd": &cmds.AutoCcCmd,
+	}
+	for k, ptr := range b4Entries {
+		v, err := getB4Config(k)
+		if err != nil {
+			return nil, err
+		}
+		*ptr = v
+	}
+
+	if cmds == (recipientCmds{}) {
+		return nil, nil
+	}
+	return &cmds, nil
+}
+
+// run runs the commands for a patch. Like git-send-email, the patch is
+// written to a file whose name is passed to the commands, b4 commands read it
+// from stdin instead. Cc commands are skipped if suppressed by the policy.
+func (cmds *recipientCmds) run(ctx context.Context, patch []byte, policy *ccPolicy) (*recipientCmdsResult, error) {
+	f, err := os.CreateTemp("", "pyonji-*.patch")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary patch file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(patch); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write temporary patch file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write temporary patch file: %v", err)
+	}
+
+	var res recipientCmdsResult
+	if cmds.ToCmd != "" {
+		res.To, err = runRecipientCmd(ctx, "sendemail.toCmd", cmds.ToCmd+` "$1"`, f.Name())
+	} else if cmds.AutoToCmd != "" {
+		res.To, err = runRecipientCmd(ctx, "b4.send-auto-to-cmd", cmds.AutoToCmd+` <"$1"`, f.Name())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !policy.suppressed("cccmd") {
+		var cc []*mail.Address
+		if cmds.CcCmd != "" {
+			cc, err = runRecipientCmd(ctx, "sendemail.ccCmd", cmds.CcCmd+` "$1"`, f.Name())
+		} else if cmds.AutoCcCmd != "" {
+			cc, err = runRecipientCmd(ctx, "b4.send-auto-cc-cmd", cmds.AutoCcCmd+` <"$1"`, f.Name())
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Cc = policy.appendUnique(nil, cc...)
+	}
+	if cmds.HeaderCmd != "" {
+		lines, err := runPatchCmd(ctx, "sendemail.headerCmd", cmds.HeaderCmd+` "$1"`, f.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lines {
+			if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(res.Header) > 0 {
+				// Continuation line
+				field := &res.Header[len(res.Header)-1]
+				field.Value += " " + strings.TrimSpace(l)
+				continue
+			}
+			k, v, ok := strings.Cut(l, ":")
+			if !ok || !isTrailerKey(k) {
+				return nil, fmt.Errorf("sendemail.headerCmd printed an invalid header: %q", l)
+			}
+			res.Header = append(res.Header, headerField{k, strings.TrimSpace(v)})
+		}
+
+		// Recipients in the headers are merged with the other ones
+		var header []headerField
+		for _, field := range res.Header {
+			var l *[]*mail.Address
+			switch strings.ToLower(field.Key) {
+			case "to":
+				l = &res.To
+			case "cc":
+				l = &res.Cc
+			default:
+				header = append(header, field)
+				continue
+			}
+			addrs, err := mail.ParseAddressList(field.Value)
+			if err != nil {
+				return nil, fmt.Errorf("sendemail.headerCmd printed an invalid %v header: %v", field.Key, err)
+			}
+			*l = appendAddressUnique(*l, addrs...)
+		}
+		res.Header = header
+	}
+
+	return &res, nil
+}
+
+// runPatchCmd runs a shell script referring to the patch file as "$1", and
+// returns the non-empty lines it prints.
+func runPatchCmd(ctx context.Context, name, script, filename string) ([]string, error) {
+	toplevelDir, err := getGitToplevelDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", script, "-", filename)
+	// Commands such as scripts/get_maintainer.pl expect to be run from the
+	// top-level directory
+	cmd.Dir = toplevelDir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v failed: %v: %v", name, err, msg)
+		}
+		return nil, fmt.Errorf("%v failed: %v", name, err)
+	}
+
+	var lines []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, strings.TrimRight(l, "\r"))
+		}
+	}
+	return lines, nil
+}
+
+// runRecipientCmd runs a command printing one address per line.
+func runRecipientCmd(ctx context.Context, name, script, filename string) ([]*mail.Address, error) {
+	lines, err := runPatchCmd(ctx, name, script, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []*mail.Address
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		addr, err := mail.ParseAddress(l)
+		if err != nil {
+			// Strip role statistics, e.g. "(maintainer:FOO)"
+			if i := strings.LastIndex(l, " ("); i > 0 && strings.HasSuffix(l, ")") {
+				addr, err = mail.ParseAddress(l[:i])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v printed an invalid address %q: %v", name, l, err)
+		}
+		addrs = appendAddressUnique(addrs, addr)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+)
+
+type trailer struct {
+	Key, Value string
+}
+
+// parseTrailers extracts the trailers from the last paragraph of a commit
+// message.
+func parseTrailers(msg string) []trailer {
+	msg = strings.TrimRight(msg, "\n")
+	if i := strings.LastIndex(msg, "\n\n"); i >= 0 {
+		msg = msg[i+2:]
+	}
+
+	var trailers []trailer
+	for _, l := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+			// Continuation line
+			if len(trailers) > 0 {
+				t := &trailers[len(trailers)-1]
+				t.Value += " " + strings.TrimSpace(l)
+			}
+			continue
+		}
+
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || !isTrailerKey(k) {
+			continue
+		}
+		trailers = append(trailers, trailer{k, strings.TrimSpace(v)})
+	}
+	return trailers
+}
+
+func isTrailerKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// patchCommitMessage returns the commit message part of a patch body, ie.
+// everything before the "---" separator.
+func patchCommitMessage(body []byte) string {
+	s := strings.ReplaceAll(string(body), "\r\n", "\n")
+	if strings.HasPrefix(s, "---\n") {
+		return ""
+	}
+	msg, _, _ := strings.Cut(s, "\n---\n")
+	return msg
+}
+
+// ccPolicy decides which addresses get Cc'ed on a patch, following the rules
+// of git-send-email.
+type ccPolicy struct {
+	suppress map[string]bool
+	self     string
+}
+
+// Trailers which add a Cc, and their git-send-email suppression category
+var trailerCcCategories = map[string]string{
+	"signed-off-by":   "sob",
+	"reviewed-by":     "misc-by",
+	"acked-by":        "misc-by",
+	"tested-by":       "misc-by",
+	"reported-by":     "misc-by",
+	"co-developed-by": "misc-by",
+	"cc":              "bodycc",
+}
+
+func loadCcPolicy(identity string, from *mail.Address) (*ccPolicy, error) {
+	values, err := getAllSendEmailConfig(identity, "suppressCc")
+	if err != nil {
+		return nil, err
+	}
+
+	suppress := make(map[string]bool)
+	for _, v := range values {
+		switch v {
+		case "author", "self", "cc", "bodycc", "sob", "misc-by", "cccmd":
+			suppress[v] = true
+		case "body":
+			suppress["sob"] = true
+			suppress["bodycc"] = true
+			suppress["misc-by"] = true
+		case "all":
+			suppress["all"] = true
+		default:
+			return nil, fmt.Errorf("invalid sendemail.suppressCc %q", v)
+		}
+	}
+
+	// Like git-send-email, suppressFrom overrides the "self" category
+	suppressFromKey, err := sendEmailConfigKey(identity, "suppressFrom")
+	if err != nil {
+		return nil, err
+	}
+	if v, ok, err := lookupGitConfigWithArgs(suppressFromKey, "--type=bool"); err != nil {
+		return nil, err
+	} else if ok {
+		suppress["self"] = v == "true"
+	}
+
+	signedOffByCcKey, err := sendEmailConfigKey(identity, "signedOffByCc")
+	if err != nil {
+		return nil, err
+	}
+	signedOffByCc, err := getGitConfigBool(signedOffByCcKey, true)
+	if err != nil {
+		return nil, err
+	} else if !signedOffByCc {
+		suppress["sob"] = true
+	}
+
+	return &ccPolicy{suppress: suppress, self: from.Address}, nil
+}
+
+func (p *ccPolicy) suppressed(category string) bool {
+	return p.suppress["all"] || p.suppress[category]
+}
+
+// collect returns the addresses to Cc for a patch with the specified author
+// and commit message.
+func (p *ccPolicy) collect(author *mail.Address, msg string) []*mail.Address {
+	var l []*mail.Address
+	add := func(addr *mail.Address) {
+		if p.suppressed("self") && strings.EqualFold(addr.Address, p.self) {
+			return
+		}
+		l = appendAddressUnique(l, addr)
+	}
+
+	if author != nil && author.Address != "" && !p.suppressed("author") {
+		add(author)
+	}
+
+	for _, t := range parseTrailers(msg) {
+		category, ok := trailerCcCategories[strings.ToLower(t.Key)]
+		if !ok || p.suppressed(category) {
+			continue
+		}
+		// Strip comments such as "Cc: <stable@vger.kernel.org> # 6.1"
+		v, _, _ := strings.Cut(t.Value, "#")
+		// Ignore unparseable trailers, just like git-send-email
+		addrs, err := mail.ParseAddressList(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			add(addr)
+		}
+	}
+
+	return l
+}
+
+// appendUnique is like appendAddressUnique, but leaves out the sender if
+// suppressed.
+func (p *ccPolicy) appendUnique(l []*mail.Address, addrs ...*mail.Address) []*mail.Address {
+	for _, addr := range addrs {
+		if p.suppressed("self") && strings.EqualFold(addr.Address, p.self) {
+			continue
+		}
+		l = appendAddressUnique(l, addr)
+	}
+	return l
+}
+
+func appendAddressUnique(l []*mail.Address, addrs ...*mail.Address) []*mail.Address {
+	for _, addr := range addrs {
+		if !containsAddress(l, addr.Address) {
+			l = append(l, addr)
+		}
+	}
+	return l
+}
+
+func containsAddress(l []*mail.Address, addr string) bool {
+	for _, other := range l {
+		if strings.EqualFold(other.Address, addr) {
+			return true
+		}
+	}
+	return false
+}
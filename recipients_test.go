@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+func TestCcPolicyCollect(t *testing.T) {
+	author := &mail.Address{Name: "Joe Doe", Address: "joe@example.org"}
+	msg := `Fix the foo driver
+
+Reported-by: Reporter <reporter@example.org>
+Cc: <stable@example.org> # 6.1
+Cc: not an address
+Signed-off-by: Joe Doe <joe@example.org>
+Signed-off-by: Me <me@example.org>
+`
+
+	tests := []struct {
+		name     string
+		suppress []string
+		want     string
+	}{
+		{
+			name: "none",
+			want: "Joe Doe <joe@example.org>, Reporter <reporter@example.org>, stable@example.org, Me <me@example.org>",
+		},
+		{
+			name:     "self",
+			suppress: []string{"self"},
+			want:     "Joe Doe <joe@example.org>, Reporter <reporter@example.org>, stable@example.org",
+		},
+		{
+			name:     "author",
+			suppress: []string{"author"},
+			want:     "Reporter <reporter@example.org>, stable@example.org, Joe Doe <joe@example.org>, Me <me@example.org>",
+		},
+		{
+			name:     "author and sob",
+			suppress: []string{"author", "sob"},
+			want:     "Reporter <reporter@example.org>, stable@example.org",
+		},
+		{
+			name:     "misc-by",
+			suppress: []string{"misc-by"},
+			want:     "Joe Doe <joe@example.org>, stable@example.org, Me <me@example.org>",
+		},
+		{
+			name:     "bodycc",
+			suppress: []string{"bodycc"},
+			want:     "Joe Doe <joe@example.org>, Reporter <reporter@example.org>, Me <me@example.org>",
+		},
+		{
+			name:     "all",
+			suppress: []string{"all"},
+			want:     "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := &ccPolicy{suppress: make(map[string]bool), self: "me@example.org"}
+			for _, category := range tc.suppress {
+				policy.suppress[category] = true
+			}
+			if got := formatAddressList(policy.collect(author, msg)); got != tc.want {
+				t.Errorf("collect() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// SASL mechanisms not provided by go-sasl
+const (
+	cramMD5     = "CRAM-MD5"
+	scramSHA256 = "SCRAM-SHA-256"
+	xoauth2     = "XOAUTH2"
+)
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism, which predates
+// OAUTHBEARER but is still the only one supported by some providers. See:
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+type xoauth2Client struct {
+	username, token string
+}
+
+var _ sasl.Client = (*xoauth2Client)(nil)
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01")
+	return xoauth2, ir, nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// On failure, the server sends a JSON error as a challenge and expects
+	// an empty response before replying with the final error
+	return []byte{}, nil
+}
+
+// cramMD5Client implements the CRAM-MD5 SASL mechanism, see RFC 2195.
+type cramMD5Client struct {
+	username, password string
+}
+
+var _ sasl.Client = (*cramMD5Client)(nil)
+
+func (c *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return cramMD5, nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// scramClient implements the SCRAM-SHA-256 SASL mechanism without channel
+// binding, see RFC 5802 and RFC 7677. The password isn't normalized with
+// SASLprep, which only matters for non-ASCII passwords.
+type scramClient struct {
+	username, password string
+
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+var _ sasl.Client = (*scramClient)(nil)
+
+func newSCRAMSHA256Client(username, password string) *scramClient {
+	return &scramClient{username: username, password: password}
+}
+
+func (c *scramClient) Start() (mech string, ir []byte, err error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", nil, err
+	}
+	c.clientNonce = base64.RawStdEncoding.EncodeToString(nonce[:])
+
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+	c.clientFirstBare = "n=" + username + ",r=" + c.clientNonce
+	return scramSHA256, []byte("n,," + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.handleServerFirst(string(challenge))
+	case 2:
+		return c.handleServerFinal(string(challenge))
+	default:
+		return nil, errors.New("SCRAM: unexpected server challenge")
+	}
+}
+
+func (c *scramClient) handleServerFirst(serverFirst string) ([]byte, error) {
+	attrs := parseSCRAMAttrs(serverFirst)
+	nonce, salt64, iterStr := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, errors.New("SCRAM: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, fmt.Errorf("SCRAM: invalid salt: %v", err)
+	}
+	iter, err := strconv.Atoi(iterStr)
+	if err != nil || iter <= 0 {
+		return nil, fmt.Errorf("SCRAM: invalid iteration count %q", iterStr)
+	}
+
+	saltedPassword := pbkdf2(sha256.New, []byte(c.password), salt, iter, sha256.Size)
+	clientKey := hmacSum(sha256.New, saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSum(sha256.New, saltedPassword, []byte("Server Key"))
+
+	// "biws" is the base64-encoded GS2 header "n,,"
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	clientSignature := hmacSum(sha256.New, storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = hmacSum(sha256.New, serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (c *scramClient) handleServerFinal(serverFinal string) ([]byte, error) {
+	attrs := parseSCRAMAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("SCRAM: server error: %v", e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(sig, c.serverSignature) {
+		return nil, errors.New("SCRAM: invalid server signature")
+	}
+	return []byte{}, nil
+}
+
+func parseSCRAMAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func hmacSum(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key from a password, see RFC 8018 section 5.2.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	mac := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		mac.Reset()
+		mac.Write(salt)
+		binary.Write(mac, binary.BigEndian, block)
+		u := mac.Sum(nil)
+
+		t := append([]byte(nil), u...)
+		for n := 1; n < iter; n++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
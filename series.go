@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Settings and history kept per series. They are stored in the
+// pyonjiSeries.<change-id> section of the Git config once the branch is
+// attached to a change-id, and in the branch section before that.
+var seriesConfigKeys = []string{
+	"pyonjiIdentity",
+	"pyonjiTo",
+	"pyonjiCc",
+	"pyonjiBase",
+	"pyonjiRerollCount",
+	"pyonjiLastSentHash",
+	"pyonjiSentVersion",
+}
+
+var changeIDSlugRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Maximum length of the branch name part of generated change-ids
+const maxChangeIDSlugLen = 32
+
+// generateChangeID creates a new change-id for a branch, in the same format
+// as b4 prep: date, branch name and random suffix.
+func generateChangeID(branch string) (string, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate change-id: %v", err)
+	}
+
+	slug := changeIDSlugRegexp.ReplaceAllString(strings.ToLower(branch), "-")
+	if len(slug) > maxChangeIDSlugLen {
+		slug = slug[:maxChangeIDSlugLen]
+	}
+	slug = strings.Trim(slug, "-")
+
+	parts := []string{time.Now().Format("20060102")}
+	if slug != "" {
+		parts = append(parts, slug)
+	}
+	parts = append(parts, hex.EncodeToString(b[:]))
+	return strings.Join(parts, "-"), nil
+}
+
+func getBranchChangeID(branch string) (string, error) {
+	if branch == "" {
+		return "", nil
+	}
+	return getGitConfig("branch." + branch + ".pyonjiChangeId")
+}
+
+// loadSeriesChangeID returns the change-id of a branch. If the branch isn't
+// attached to a series yet, the b4 change-id is picked up, or a new one is
+// generated. The branch is only attached to it once the submission settings
+// are saved.
+func loadSeriesChangeID(branch string, tracking *b4Tracking) (string, error) {
+	if branch == "" {
+		return "", nil
+	}
+	changeID, err := getBranchChangeID(branch)
+	if err != nil || changeID != "" {
+		return changeID, err
+	}
+	if tracking != nil && tracking.ChangeID() != "" {
+		return tracking.ChangeID(), nil
+	}
+	return generateChangeID(branch)
+}
+
+// seriesConfigKey returns the Git config key of a per-series setting of a
+// branch. changeID is the change-id the branch is about to be attached to, if
+// any: the settings of that series are used if it already has some, as they
+// are kept when attaching.
+func seriesConfigKey(branch, changeID, k string) (string, error) {
+	cur, err := getBranchChangeID(branch)
+	if err != nil {
+		return "", err
+	}
+	if changeID != "" && changeID != cur && checkSeriesExists(changeID) {
+		return seriesSectionKey(changeID, k), nil
+	} else if cur == "" {
+		return "branch." + branch + "." + k, nil
+	}
+	return seriesSectionKey(cur, k), nil
+}
+
+func seriesSectionKey(changeID, k string) string {
+	k = strings.TrimPrefix(k, "pyonji")
+	return "pyonjiSeries." + changeID + "." + strings.ToLower(k[:1]) + k[1:]
+}
+
+// checkSeriesExists checks whether pyonji has settings or history for a
+// change-id.
+func checkSeriesExists(changeID string) bool {
+	pattern := `^pyonjiseries\.` + regexp.QuoteMeta(changeID) + `\.`
+	cmd := exec.Command("git", "config", "--get-regexp", pattern)
+	return cmd.Run() == nil
+}
+
+// attachSeries attaches a branch to a change-id. The settings and history
+// saved in the branch section are moved to the series section, unless the
+// series already has its own, e.g. when re-attaching a branch recreated after
+// a rebase.
+func attachSeries(branch, changeID string) error {
+	if branch == "" || changeID == "" {
+		return nil
+	}
+	cur, err := getBranchChangeID(branch)
+	if err != nil || cur == changeID {
+		return err
+	}
+
+	for _, k := range seriesConfigKeys {
+		branchKey := "branch." + branch + "." + k
+		values, err := getAllGitConfig(branchKey)
+		if err != nil {
+			return err
+		}
+
+		seriesKey := seriesSectionKey(changeID, k)
+		existing, err := getAllGitConfig(seriesKey)
+		if err != nil {
+			return err
+		}
+		if cur == "" && len(existing) == 0 {
+			for _, v := range values {
+				if err := addGitConfig(seriesKey, v); err != nil {
+					return err
+				}
+			}
+		}
+		if err := unsetAllGitConfig(branchKey); err != nil {
+			return err
+		}
+	}
+
+	return setGitConfig("branch."+branch+".pyonjiChangeId", changeID)
+}
+
+// checkReattachSeries checks whether a branch can be attached to an existing
+// series, e.g. after it has been recreated or renamed with a tool which
+// doesn't preserve the branch config.
+func checkReattachSeries(branch, changeID string) error {
+	if branch == "" {
+		return fmt.Errorf("cannot attach a series: not on a branch")
+	}
+	if !checkSeriesExists(changeID) {
+		return fmt.Errorf("unknown change-id %q", changeID)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateChangeID(t *testing.T) {
+	date := time.Now().Format("20060102")
+	tests := []struct {
+		branch string
+		prefix string
+	}{
+		{"feature", date + "-feature-"},
+		{"Fix/Foo_bar", date + "-fix-foo-bar-"},
+		{"--", date + "-"},
+		{"", date + "-"},
+		{strings.Repeat("a", 40), date + "-" + strings.Repeat("a", maxChangeIDSlugLen) + "-"},
+	}
+	suffixRegexp := regexp.MustCompile(`^[0-9a-f]{12}$`)
+	for _, tc := range tests {
+		changeID, err := generateChangeID(tc.branch)
+		if err != nil {
+			t.Fatalf("generateChangeID(%q) = %v", tc.branch, err)
+		}
+		if !strings.HasPrefix(changeID, tc.prefix) || !suffixRegexp.MatchString(strings.TrimPrefix(changeID, tc.prefix)) {
+			t.Errorf("generateChangeID(%q) = %q, want %q followed by a random suffix", tc.branch, changeID, tc.prefix)
+		}
+	}
+}
+
+func TestSeriesSectionKey(t *testing.T) {
+	for _, k := range seriesConfigKeys {
+		got := seriesSectionKey("20240101-foo-0123456789ab", k)
+		want := "pyonjiSeries.20240101-foo-0123456789ab." + strings.ToLower(k[6:7]) + k[7:]
+		if got != want {
+			t.Errorf("seriesSectionKey(%q) = %q, want %q", k, got, want)
+		}
+	}
+
+	if got, want := seriesSectionKey("id", "pyonjiLastSentHash"), "pyonjiSeries.id.lastSentHash"; got != want {
+		t.Errorf("seriesSectionKey() = %q, want %q", got, want)
+	}
+}
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
@@ -15,6 +28,64 @@ type smtpConfig struct {
 	mailconfig.SMTP
 	InsecureNoTLS bool
 	Password      string
+	// TokenSource is set when OAuth2 is used. For the refresh-token flow,
+	// Password holds the refresh token.
+	TokenSource *oauth2TokenSource
+	// StoreCredential is set when the password didn't come from the Git
+	// config. It's then stored with Git credential helpers once
+	// authentication succeeds.
+	StoreCredential bool
+	// AuthMechs restricts the allowed SASL mechanisms, if non-empty
+	AuthMechs []string
+	// NoAuth disables authentication
+	NoAuth bool
+	// Timeout for SMTP commands, defaultSMTPTimeout if zero
+	Timeout time.Duration
+	// Domain is the name sent in EHLO, if non-empty
+	Domain string
+
+	// CACertPath is a file or directory containing the CA certificates used
+	// to verify the server, the system ones are used if empty
+	CACertPath string
+	// InsecureSkipVerify disables server certificate verification
+	InsecureSkipVerify bool
+	// CertFingerprint is the SHA-256 fingerprint of the server certificate.
+	// If set, it is checked instead of the certificate chain.
+	CertFingerprint []byte
+	// Client certificate and key, the key may be in the certificate file
+	ClientCertPath, ClientKeyPath string
+}
+
+const defaultSMTPTimeout = time.Minute
+
+// needsPassword returns true if a password (or a refresh token) needs to be
+// fetched from Git credential helpers.
+func (cfg *smtpConfig) needsPassword() bool {
+	if cfg.Username == "" || cfg.NoAuth {
+		return false
+	}
+	return cfg.Password == "" && (cfg.TokenSource == nil || cfg.TokenSource.usesRefreshToken())
+}
+
+func (cfg *smtpConfig) credential() *gitCredential {
+	return &gitCredential{
+		Protocol: "smtp",
+		Host:     net.JoinHostPort(cfg.Hostname, cfg.Port),
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}
+}
+
+// fillCredential fetches the password from Git credential helpers. If prompt
+// is true and none has it, the user is asked for it on the terminal.
+func (cfg *smtpConfig) fillCredential(prompt bool) error {
+	cred := cfg.credential()
+	if err := fillGitCredential(cred, prompt); err != nil {
+		return err
+	}
+	cfg.Password = cred.Password
+	cfg.StoreCredential = true
+	return nil
 }
 
 func (cfg *smtpConfig) check(ctx context.Context) error {
@@ -27,38 +98,355 @@ func (cfg *smtpConfig) check(ctx context.Context) error {
 
 func (cfg *smtpConfig) dialAndAuth(ctx context.Context) (*smtpClient, error) {
 	addr := net.JoinHostPort(cfg.Hostname, cfg.Port)
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultSMTPTimeout
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	var (
-		c   *smtp.Client
-		err error
+		conn   net.Conn
+		dialer = net.Dialer{Timeout: timeout}
 	)
 	if cfg.StartTLS || cfg.InsecureNoTLS {
-		c, err = smtp.Dial(addr)
-		if err == nil && !cfg.InsecureNoTLS {
-			err = c.StartTLS(nil)
-		}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
 	} else {
-		c, err = smtp.DialTLS(addr, nil)
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
 	}
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to connect to mail server: %v", err)
 	}
 
-	if err := c.Auth(sasl.NewPlainClient("", cfg.Username, cfg.Password)); err != nil {
-		c.Close()
-		return nil, err
+	c := &smtpClient{Client: smtp.NewClient(conn), conn: conn, timeout: timeout}
+	c.CommandTimeout = timeout
+	// Servers may take a while to accept a message, e.g. to scan it
+	c.SubmissionTimeout = 5 * timeout
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	if cfg.Domain != "" {
+		if err := c.Hello(cfg.Domain); err != nil {
+			c.Close()
+			return nil, c.wrapError(ctx, err)
+		}
+	}
+
+	if cfg.StartTLS && !cfg.InsecureNoTLS {
+		if err := c.Client.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, c.wrapError(ctx, err)
+		}
+	}
+
+	if cfg.Username != "" && !cfg.NoAuth {
+		if err := cfg.auth(ctx, c.Client); err != nil {
+			c.Close()
+			return nil, c.wrapError(ctx, err)
+		}
 	}
 
-	return &smtpClient{c}, err
+	return c, nil
+}
+
+func (cfg *smtpConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.Hostname,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CACertPath != "" {
+		pool, err := loadCertPool(cfg.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertPath != "" {
+		keyPath := cfg.ClientKeyPath
+		if keyPath == "" {
+			keyPath = cfg.ClientCertPath
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SMTP client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CertFingerprint != nil {
+		// The pinned certificate replaces the usual chain verification,
+		// so that self-signed certificates can be used
+		fingerprint := cfg.CertFingerprint
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("mail server didn't send a certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf("mail server certificate fingerprint mismatch: got %v, want %v", formatCertFingerprint(sum[:]), formatCertFingerprint(fingerprint))
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool loads PEM certificates from a file, or from all files in a
+// directory.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificates: %v", err)
+	}
+
+	filenames := []string{path}
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certificates: %v", err)
+		}
+		filenames = nil
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				filenames = append(filenames, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	pool := x509.NewCertPool()
+	found := false
+	for _, filename := range filenames {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certificates: %v", err)
+		}
+		if pool.AppendCertsFromPEM(b) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no CA certificate found in %q", path)
+	}
+	return pool, nil
+}
+
+// parseCertFingerprint parses a hex-encoded SHA-256 fingerprint, optionally
+// with colons between bytes.
+func parseCertFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", s)
+	}
+	return b, nil
+}
+
+func formatCertFingerprint(b []byte) string {
+	l := make([]string, len(b))
+	for i, v := range b {
+		l[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(l, ":")
+}
+
+// Supported SASL mechanisms, by order of preference
+var (
+	passwordAuthMechs = []string{scramSHA256, cramMD5, sasl.Login, sasl.Plain}
+	oauth2AuthMechs   = []string{sasl.OAuthBearer, xoauth2}
+)
+
+// cleartextAuthMechs lists mechanisms which send the password or token as-is
+var cleartextAuthMechs = []string{sasl.Login, sasl.Plain, sasl.OAuthBearer, xoauth2}
+
+// negotiateAuthMech picks the preferred SASL mechanism supported by both the
+// server and pyonji, restricted by sendemail.smtpAuth.
+func (cfg *smtpConfig) negotiateAuthMech(c *smtp.Client) (string, error) {
+	ok, advertised := c.Extension("AUTH")
+	if !ok {
+		return "", fmt.Errorf("mail server doesn't support authentication, unset sendemail.smtpUser to send without authenticating")
+	}
+	return cfg.selectAuthMech(strings.Fields(advertised))
+}
+
+// selectAuthMech picks the preferred SASL mechanism among the ones supported
+// by the server.
+func (cfg *smtpConfig) selectAuthMech(serverMechs []string) (string, error) {
+	candidates := passwordAuthMechs
+	if cfg.TokenSource != nil {
+		candidates = oauth2AuthMechs
+	} else if len(cfg.AuthMechs) > 0 {
+		// With git-send-email, OAuth2 tokens are provided as passwords
+		candidates = append(append([]string(nil), oauth2AuthMechs...), passwordAuthMechs...)
+	}
+
+	insecure := false
+	for _, mech := range candidates {
+		if len(cfg.AuthMechs) > 0 && !containsFold(cfg.AuthMechs, mech) {
+			continue
+		}
+		if !containsFold(serverMechs, mech) {
+			continue
+		}
+		// Mechanisms explicitly allowed in sendemail.smtpAuth are used as-is
+		if cfg.InsecureNoTLS && len(cfg.AuthMechs) == 0 && containsFold(cleartextAuthMechs, mech) {
+			insecure = true
+			continue
+		}
+		return mech, nil
+	}
+
+	if insecure {
+		return "", fmt.Errorf("refusing to send credentials in cleartext over a connection without TLS (set sendemail.smtpAuth to allow it)")
+	}
+	return "", fmt.Errorf("no supported authentication mechanism (mail server supports: %v)", strings.Join(serverMechs, ", "))
+}
+
+func (cfg *smtpConfig) auth(ctx context.Context, c *smtp.Client) error {
+	mech, err := cfg.negotiateAuthMech(c)
+	if err != nil {
+		return err
+	}
+
+	var saslClient sasl.Client
+	switch mech {
+	case scramSHA256:
+		saslClient = newSCRAMSHA256Client(cfg.Username, cfg.Password)
+	case cramMD5:
+		saslClient = &cramMD5Client{cfg.Username, cfg.Password}
+	case sasl.Login:
+		saslClient = sasl.NewLoginClient(cfg.Username, cfg.Password)
+	case sasl.Plain:
+		saslClient = sasl.NewPlainClient("", cfg.Username, cfg.Password)
+	case sasl.OAuthBearer, xoauth2:
+		token, err := cfg.oauth2Token(ctx)
+		if err != nil {
+			return err
+		}
+		if mech == xoauth2 {
+			saslClient = &xoauth2Client{cfg.Username, token}
+		} else {
+			port, _ := strconv.Atoi(cfg.Port)
+			saslClient = sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+				Username: cfg.Username,
+				Token:    token,
+				Host:     cfg.Hostname,
+				Port:     port,
+			})
+		}
+	}
+
+	if err := c.Auth(saslClient); err != nil {
+		// With a token source, the rejected credential is a short-lived
+		// access token: keep the stored refresh token
+		if isSMTPAuthError(err) && cfg.TokenSource == nil {
+			rejectGitCredential(cfg.credential())
+		}
+		return fmt.Errorf("%v authentication failed: %v", mech, err)
+	}
+
+	// The server has accepted the credential, failing to store it
+	// shouldn't prevent sending
+	if cfg.StoreCredential && (cfg.TokenSource == nil || cfg.TokenSource.usesRefreshToken()) {
+		if err := approveGitCredential(cfg.credential()); err != nil {
+			log.Printf("warning: failed to store credential: %v", err)
+		}
+	}
+	return nil
+}
+
+// oauth2Token returns an OAuth2 access token. Without a token source, the
+// password is used as the token, like git-send-email does.
+func (cfg *smtpConfig) oauth2Token(ctx context.Context) (string, error) {
+	src := cfg.TokenSource
+	if src == nil {
+		return cfg.Password, nil
+	} else if !src.usesRefreshToken() {
+		return src.runCmd(ctx)
+	}
+
+	token, refreshToken, err := src.refresh(ctx, cfg.Password)
+	var grantErr *oauth2GrantError
+	if errors.As(err, &grantErr) {
+		rejectGitCredential(cfg.credential())
+	}
+	if err != nil {
+		return "", err
+	}
+	if refreshToken != "" {
+		// The refresh token has been rotated, the new one is stored once
+		// authentication succeeds
+		cfg.Password = refreshToken
+	}
+	return token, nil
+}
+
+func containsFold(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSMTPAuthError(err error) bool {
+	var smtpErr *smtp.SMTPError
+	// 535 is "authentication credentials invalid", see RFC 4954 section 6
+	return errors.As(err, &smtpErr) && smtpErr.Code == 535
 }
 
 type smtpClient struct {
 	*smtp.Client
+	conn    net.Conn
+	timeout time.Duration
+}
+
+var _ mailSender = (*smtpClient)(nil)
+
+func (c *smtpClient) SendMail(ctx context.Context, from string, to []string, data io.Reader) error {
+	stop := closeOnDone(ctx, c.conn)
+	defer stop()
+
+	if err := c.Client.SendMail(from, to, data); err != nil {
+		return c.wrapError(ctx, err)
+	}
+	return nil
 }
 
-var _ mailSender = smtpClient{}
+// wrapError replaces errors caused by the connection being closed on context
+// cancellation or by a timeout with more helpful ones.
+func (c *smtpClient) wrapError(ctx context.Context, err error) error {
+	var netErr net.Error
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("mail server stopped responding (timeout after %v)", c.timeout)
+	}
+	return err
+}
 
-func (c smtpClient) SendMail(ctx context.Context, from string, to []string, data io.Reader) error {
-	// TODO: pass the context somehow
-	return c.Client.SendMail(from, to, data)
+// closeOnDone closes the connection when the context is cancelled, to
+// forcibly abort any pending command. The returned function must be called
+// once the commands are done.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+			// nothing to do
+		}
+	}()
+	return func() { close(done) }
 }
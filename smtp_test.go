@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestSelectAuthMech(t *testing.T) {
+	allMechs := []string{sasl.Plain, sasl.Login, cramMD5, scramSHA256, sasl.OAuthBearer, xoauth2}
+	tests := []struct {
+		name        string
+		cfg         smtpConfig
+		serverMechs []string
+		want        string // empty if an error is expected
+	}{
+		{
+			name:        "preferred",
+			serverMechs: allMechs,
+			want:        scramSHA256,
+		},
+		{
+			name:        "plain only",
+			serverMechs: []string{sasl.Plain},
+			want:        sasl.Plain,
+		},
+		{
+			name:        "case-insensitive",
+			serverMechs: []string{"login", "plain"},
+			want:        sasl.Login,
+		},
+		{
+			name:        "unsupported",
+			serverMechs: []string{"GSSAPI"},
+		},
+		{
+			name:        "OAuth2",
+			cfg:         smtpConfig{TokenSource: &oauth2TokenSource{Cmd: "true"}},
+			serverMechs: allMechs,
+			want:        sasl.OAuthBearer,
+		},
+		{
+			name:        "OAuth2 unsupported by server",
+			cfg:         smtpConfig{TokenSource: &oauth2TokenSource{Cmd: "true"}},
+			serverMechs: []string{sasl.Plain},
+		},
+		{
+			name:        "smtpAuth",
+			cfg:         smtpConfig{AuthMechs: []string{"plain", "xoauth2"}},
+			serverMechs: allMechs,
+			want:        xoauth2,
+		},
+		{
+			name:        "smtpAuth unsupported by server",
+			cfg:         smtpConfig{AuthMechs: []string{"CRAM-MD5"}},
+			serverMechs: []string{sasl.Plain},
+		},
+		{
+			name:        "no TLS",
+			cfg:         smtpConfig{InsecureNoTLS: true},
+			serverMechs: allMechs,
+			want:        scramSHA256,
+		},
+		{
+			name:        "no TLS cleartext",
+			cfg:         smtpConfig{InsecureNoTLS: true},
+			serverMechs: []string{sasl.Plain, sasl.Login},
+		},
+		{
+			name:        "no TLS cleartext allowed by smtpAuth",
+			cfg:         smtpConfig{InsecureNoTLS: true, AuthMechs: []string{"PLAIN"}},
+			serverMechs: []string{sasl.Plain, sasl.Login},
+			want:        sasl.Plain,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mech, err := tc.cfg.selectAuthMech(tc.serverMechs)
+			if tc.want == "" {
+				if err == nil {
+					t.Errorf("selectAuthMech() = %q, want an error", mech)
+				}
+			} else if err != nil {
+				t.Errorf("selectAuthMech() = %v", err)
+			} else if mech != tc.want {
+				t.Errorf("selectAuthMech() = %q, want %q", mech, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Maximum number of series a series can be stacked on
+const maxSeriesStackDepth = 10
+
+// parentSeries is a feature branch which another series is based on.
+type parentSeries struct {
+	Branch     string
+	BaseBranch string       // may be empty for branches sent by old versions
+	Version    *sentVersion // latest sent version, nil if never sent
+}
+
+// seriesStack lists the series a series depends on, closest first.
+type seriesStack []parentSeries
+
+// loadSeriesStack walks up the base branches while they are feature branches
+// tracked by pyonji, i.e. local branches which have been sent or have a saved
+// base branch. nil is returned if the base branch is a mainline branch.
+func loadSeriesStack(baseBranch string) (seriesStack, error) {
+	var (
+		stack  seriesStack
+		branch = baseBranch
+		seen   = make(map[string]bool)
+	)
+	for branch != "" && !seen[branch] && len(stack) < maxSeriesStackDepth && checkGitLocalBranch(branch) {
+		seen[branch] = true
+
+		cfg, err := loadSubmissionConfig(branch, "")
+		if err != nil {
+			return nil, err
+		}
+		versions, err := loadSentVersions(branch, "")
+		if err != nil {
+			return nil, err
+		}
+		if cfg.baseBranch == "" && len(versions) == 0 {
+			break
+		}
+
+		parent := parentSeries{Branch: branch, BaseBranch: cfg.baseBranch}
+		if len(versions) > 0 {
+			parent.Version = &versions[len(versions)-1]
+		}
+		stack = append(stack, parent)
+		branch = cfg.baseBranch
+	}
+	return stack, nil
+}
+
+// mainlineBranch returns the branch or commit the whole stack is based on.
+func (stack seriesStack) mainlineBranch() string {
+	if len(stack) == 0 {
+		return ""
+	}
+	root := stack[len(stack)-1]
+	if root.BaseBranch != "" {
+		return root.BaseBranch
+	} else if root.Version != nil && root.Version.Base != "" {
+		return root.Version.Base
+	}
+	// Without a known base, the root series is treated as mainline
+	return root.Branch
+}
+
+func (stack seriesStack) prerequisiteMessageIDs() []string {
+	var l []string
+	for _, parent := range stack {
+		if parent.Version != nil {
+			l = append(l, parent.Version.MessageID)
+		}
+	}
+	return l
+}
+
+// setFormatPatchOptions sets up git format-patch to describe the series
+// depended on.
+func (stack seriesStack) setFormatPatchOptions(options *gitFormatPatchOptions) {
+	if len(stack) == 0 {
+		return
+	}
+	options.MainlineBranch = stack.mainlineBranch()
+	options.PrerequisiteMessageIDs = stack.prerequisiteMessageIDs()
+}
+
+// lint checks that the series depended on have been sent as-is, and that tip
+// is based on their latest version.
+func (stack seriesStack) lint(tip string) []string {
+	var warnings []string
+	for i, parent := range stack {
+		if i == 0 && !checkGitAncestor(parent.Branch, revOrHead(tip)) {
+			warnings = append(warnings, fmt.Sprintf("Branch %q has changed since this series was based on it, rebase on it", parent.Branch))
+		}
+		if parent.Version == nil {
+			warnings = append(warnings, fmt.Sprintf("Branch %q which this series depends on hasn't been sent", parent.Branch))
+			continue
+		}
+		if parent.Version.Tip != "" {
+			parentTip, err := getGitCommit(parent.Branch)
+			if err == nil && parentTip != parent.Version.Tip {
+				warnings = append(warnings, fmt.Sprintf("Branch %q has changed since v%v was sent, reroll it first", parent.Branch, parent.Version.Version))
+			}
+		}
+	}
+	return warnings
+}
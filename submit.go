@@ -3,58 +3,143 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/emersion/go-message/mail"
 	"github.com/muesli/reflow/truncate"
-	"github.com/pborman/getopt/v2"
 )
 
 var hashStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
 
 type submissionLog struct {
+	revRange             string
 	commits              []logCommit
+	coverLetter          string
+	coverCommit          *logCommit
+	commitCc             map[string][]*mail.Address
+	commitMaintainers    map[string][]*maintainersSection
+	commitCmds           map[string]*recipientCmdsResult
+	stack                seriesStack
 	sameAsPrevSubmission bool
+	warnings             []string
 }
 
 type submissionConfig struct {
+	identity      string
 	baseBranch    string
+	tip           string // empty for HEAD
+	coverCommit   string // empty if none
 	to            []*mail.Address
+	cc            []*mail.Address
 	rerollCount   string
 	subjectPrefix string
+	inReplyTo     string
+	rangeDiff     *sentVersion
+	changeID      string // empty if not on a branch
+
+	// Don't reply to the previous version by default
+	noInReplyToPrev bool
+	// b4 prep tracking data, nil if the branch isn't managed by b4
+	b4Tracking *b4Tracking
+}
+
+type identitySwitched struct {
+	identity  string
+	gitConfig *gitSendEmailConfig
+	from      *mail.Address
+	aliases   addressAliases
+
+	// sendemail.to and cc of the previous and new identities
+	prevTo, prevCc string
+	to, cc         string
+}
+
+type baseBranchCandidatesLoaded struct {
+	candidates []baseBranchCandidate
+}
+
+type lintDone struct {
+	revRange string
+	warnings []string
+}
+
+type validationDone struct {
+	gen      int
+	failures []validationFailure
+}
+
+// baseEdited is sent after the base field has been edited, once the user
+// stopped typing.
+type baseEdited struct {
+	value string
+}
+
+type logAddressesLoaded struct {
+	addrs []*mail.Address
 }
 
 type coverLetterUpdated struct {
 	coverLetter string
+	rewritten   bool // the cover letter commit has been rewritten
+}
+
+// coverLetterEdited is sent when the cover letter has been edited in an
+// external editor.
+type coverLetterEdited struct {
+	coverLetter string
+}
+
+type submissionExported struct {
+	path      string
+	mailsSent int
 }
 
 type submissionProgress struct {
 	mailsSent  int
 	mailsTotal int
 	done       bool
+	warnings   []string // once done
 }
 
 type submitState int
 
 const (
-	submitStateTo submitState = iota
+	submitStateIdentity submitState = iota
+	submitStateBase
+	submitStateTo
+	submitStateCc
 	submitStateVersion
+	submitStateInReplyToPrev
+	submitStateRangeDiff
 	submitStateCoverLetter
 	submitStateConfirm
+	submitStateSave
+	submitStateCommits
 )
 
+// Maximum number of commits displayed at once
+const commitListHeight = 10
+
+// Delay before reloading the commits after the base field has been edited
+const baseEditDelay = 300 * time.Millisecond
+
 var (
 	labelStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
 	activeLabelStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("99"))
@@ -69,79 +154,269 @@ type submitModel struct {
 	progress  chan submissionProgress
 
 	spinner spinner.Model
+	base    textinput.Model
 	to      textinput.Model
+	cc      textinput.Model
 	version textinput.Model
+	preview viewport.Model
+
+	editingCoverLetter bool
+	coverLetterEditor  textarea.Model
+
+	linting      bool
+	lintWarnings []string
+	logWarnings  []string
+
+	// Checks to run before sending, nil if none
+	validator          *patchValidator
+	validating         bool
+	validationFailures []validationFailure
+	// Incremented each time the checks are started, to ignore stale results
+	validationGen int
+
+	// Outbox left behind by an interrupted submission, if any
+	outbox   *outbox
+	resuming bool
+
+	// Context of the submission being sent, cancelled by the user
+	sendCtx      context.Context
+	cancelSend   context.CancelFunc
+	sending      bool
+	cancelled    bool
+	sendProgress submissionProgress
+
+	// Base branches the user can pick from, if it couldn't be detected
+	baseCandidates []baseBranchCandidate
+	baseCursor     int
 
 	state                submitState
+	identity             string
+	identities           []string
+	from                 *mail.Address
+	aliases              addressAliases
+	logAddrs             []*mail.Address
 	headBranch           string
+	changeID             string
 	baseBranch           string
+	tip                  string
+	baseInvalid          bool
+	loadingLog           bool
 	coverLetter          string
+	coverCommit          *logCommit
+	coverLetterMode      coverLetterMode
 	subjectPrefix        string
+	inReplyTo            string
+	sentVersions         []sentVersion
+	inReplyToPrev        bool
+	rangeDiff            bool
 	commits              []logCommit
+	commitCc             map[string][]*mail.Address
+	commitMaintainers    map[string][]*maintainersSection
+	commitCmds           map[string]*recipientCmdsResult
+	stack                seriesStack
+	commitCursor         int
+	commitOffset         int
+	previewTitle         string
+	width, height        int
 	sameAsPrevSubmission bool
+	dryRun               bool
+	output               string
+	exported             *submissionExported
 	loadingMsg           string
 	errMsg               string
 	done                 bool
 }
 
-func initialSubmitModel(ctx context.Context, gitConfig *gitSendEmailConfig) submitModel {
-	if smtpConfig := gitConfig.SMTP; smtpConfig != nil {
-		if smtpConfig.Username == "" {
-			log.Fatal("missing sendemail.smtpUser in the Git configuration")
-		}
-		if smtpConfig.Password == "" {
-			log.Fatal("missing sendemail.smtpPass in the Git configuration")
+// submitFlags holds the command-line flags related to submissions.
+type submitFlags struct {
+	identity    string
+	baseBranch  string
+	to, cc      string
+	rerollCount string
+	inReplyTo   string
+	changeID    string
+	resume      bool
+	batch       bool
+	dryRun      bool
+	output      string
+	noValidate  bool
+}
+
+// loadInitialSubmissionConfig loads the settings for the next submission of a
+// branch: saved settings, overridden by command-line flags, with project and
+// Git defaults for missing values.
+func loadInitialSubmissionConfig(ctx context.Context, headBranch string, flags *submitFlags) (*submissionConfig, error) {
+	if flags.changeID != "" {
+		if err := checkReattachSeries(headBranch, flags.changeID); err != nil {
+			return nil, err
 		}
 	}
 
-	headBranch := findGitCurrentBranch()
-
-	cfg, err := loadSubmissionConfig(headBranch)
+	cfg, err := loadSubmissionConfig(headBranch, flags.changeID)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	var to string
-	getopt.FlagLong(&cfg.baseBranch, "base", 0, "base branch")
-	getopt.FlagLong(&to, "to", 0, "recipient")
-	getopt.FlagLong(&cfg.rerollCount, "reroll-count", 'v', "iteration number")
-	getopt.Parse()
+	cfg.identity, err = loadSendEmailIdentity(headBranch, cfg.changeID, flags.identity)
+	if err != nil {
+		return nil, err
+	}
 
-	cfg.to, err = parseAddressList(to)
+	if flags.baseBranch != "" {
+		cfg.baseBranch, cfg.tip = parseGitRevRange(flags.baseBranch)
+		if !checkGitRevRange(cfg.baseBranch, cfg.tip) {
+			return nil, fmt.Errorf("invalid --base flag: unknown revision or range %q", flags.baseBranch)
+		}
+	}
+	aliases, err := loadAddressAliases(cfg.identity)
 	if err != nil {
-		log.Fatalf("invalid --to flag: %v", err)
+		return nil, err
+	}
+	if flags.to != "" {
+		cfg.to, err = parseAddressList(aliases.expand(flags.to))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --to flag: %v", err)
+		}
 	}
+	if flags.cc != "" {
+		cfg.cc, err = parseAddressList(aliases.expand(flags.cc))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --cc flag: %v", err)
+		}
+	}
+	cfg.inReplyTo = strings.Trim(flags.inReplyTo, "<>")
 
 	if err := loadB4ProjectDefaults(cfg); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
+	// The base branch is left empty if it can't be detected
 	if cfg.baseBranch == "" {
-		cfg.baseBranch = findGitDefaultBranch()
-	}
-	if cfg.baseBranch == "" {
-		// TODO: allow user to pick
-		log.Fatal("failed to find base branch")
+		cfg.baseBranch, err = findGitBaseBranch(headBranch)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(cfg.to) == 0 {
-		to, err := loadGitSendEmailTo()
+		cfg.to, err = loadGitSendEmailTo(cfg.identity)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+	}
+	if len(cfg.cc) == 0 {
+		cfg.cc, err = loadGitSendEmailCc(cfg.identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.to) == 0 && cfg.baseBranch != "" {
+		// Suggest the mailing lists (and in series mode the maintainers)
+		// responsible for the files touched by the series
+		ms, err := loadMaintainersSuggestions()
+		if err != nil {
+			return nil, err
+		} else if ms != nil {
+			sections, err := ms.match(ctx, cfg.baseBranch+"..."+cfg.tip)
+			if err != nil {
+				return nil, err
+			}
+			lists, people := maintainersRecipients(sections)
+			cfg.to = lists
+			if ms.mode == maintainersModeSeries {
+				cfg.cc = appendAddressUnique(cfg.cc, people...)
+			}
+		}
+	}
+
+	cfg.b4Tracking, err = loadSeriesB4Tracking(ctx, headBranch, cfg.baseBranch, cfg.tip)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.changeID == "" {
+		cfg.changeID, err = loadSeriesChangeID(headBranch, cfg.b4Tracking)
+		if err != nil {
+			return nil, err
 		}
-		cfg.to = to
 	}
 
-	rerollCount, err := getNextRerollCount(headBranch, cfg.rerollCount)
+	if flags.rerollCount != "" {
+		cfg.rerollCount = flags.rerollCount
+	} else {
+		cfg.rerollCount, err = getNextRerollCount(headBranch, cfg.changeID, cfg.tip, cfg.rerollCount)
+		if err != nil {
+			return nil, err
+		}
+		sentVersions, err := loadSentVersions(headBranch, cfg.changeID)
+		if err != nil {
+			return nil, err
+		}
+		cfg.rerollCount = cfg.b4Tracking.nextRerollCount(cfg.rerollCount, sentVersions)
+	}
+
+	return cfg, nil
+}
+
+func initialSubmitModel(ctx context.Context, gitConfig *gitSendEmailConfig, flags *submitFlags) submitModel {
+	headBranch := findGitCurrentBranch()
+
+	cfg, err := loadInitialSubmissionConfig(ctx, headBranch, flags)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var ob *outbox
+	if !flags.dryRun {
+		// Nothing is sent in dry-run mode, leave any pending outbox alone
+		ob, err = loadOutbox()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flags.resume && ob == nil {
+		log.Fatal("no interrupted submission to resume")
+	} else if flags.resume {
+		// main has loaded the sendemail config of the outbox identity
+		cfg.identity = ob.Identity
+	}
+
 	coverLetter, err := loadGitBranchDescription(headBranch)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	sentVersions, err := loadSentVersions(headBranch, cfg.changeID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sentVersions = cfg.b4Tracking.mergeSentVersions(sentVersions)
+
+	identities, err := listSendEmailIdentities()
+	if err != nil {
+		log.Fatal(err)
+	}
+	coverLetterMode, err := loadCoverLetterMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+	from, err := loadGitSendEmailFrom(cfg.identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	aliases, err := loadAddressAliases(cfg.identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var validator *patchValidator
+	if !flags.noValidate && !flags.dryRun {
+		validator, err = loadPatchValidator()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	state := submitStateConfirm
 	if len(cfg.to) == 0 {
 		state = submitStateTo
@@ -151,97 +426,273 @@ func initialSubmitModel(ctx context.Context, gitConfig *gitSendEmailConfig) subm
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 
-	toInput := textinput.New()
-	toInput.Prompt = "To "
-	toInput.PromptStyle = labelStyle.Copy()
-	toInput.TextStyle = textStyle.Copy()
+	baseInput := textinput.New()
+	baseInput.Prompt = "Base "
+	baseInput.Placeholder = "branch or range, e.g. HEAD~3..HEAD"
+	baseInput.PromptStyle = labelStyle.Copy()
+	baseInput.TextStyle = textStyle.Copy()
+	baseInput.SetValue(formatGitRevRange(cfg.baseBranch, cfg.tip))
+
+	toInput := newAddressInput("To ")
 	toInput.SetValue(formatAddressList(cfg.to))
 
+	ccInput := newAddressInput("Cc ")
+	ccInput.SetValue(formatAddressList(cfg.cc))
+
 	versionInput := textinput.New()
 	versionInput.Prompt = "Version "
 	versionInput.Placeholder = "1"
 	versionInput.PromptStyle = labelStyle.Copy()
 	versionInput.TextStyle = textStyle.Copy()
-	versionInput.SetValue(rerollCount)
+	versionInput.SetValue(cfg.rerollCount)
+
+	sendCtx, cancelSend := context.WithCancel(ctx)
 
 	return submitModel{
-		ctx:           ctx,
-		gitConfig:     gitConfig,
-		progress:      make(chan submissionProgress, 1),
-		spinner:       s,
-		to:            toInput,
-		version:       versionInput,
-		headBranch:    headBranch,
-		baseBranch:    cfg.baseBranch,
-		coverLetter:   coverLetter,
-		subjectPrefix: cfg.subjectPrefix,
-		loadingMsg:    "Loading submission...",
+		ctx:               ctx,
+		sendCtx:           sendCtx,
+		cancelSend:        cancelSend,
+		sending:           flags.resume,
+		gitConfig:         gitConfig,
+		progress:          make(chan submissionProgress, 1),
+		spinner:           s,
+		base:              baseInput,
+		to:                toInput,
+		cc:                ccInput,
+		version:           versionInput,
+		coverLetterEditor: newCoverLetterEditor(),
+		outbox:            ob,
+		resuming:          flags.resume,
+		identity:          cfg.identity,
+		identities:        identities,
+		from:              from,
+		aliases:           aliases,
+		validator:         validator,
+		validating:        validator != nil && cfg.baseBranch != "",
+		headBranch:        headBranch,
+		changeID:          cfg.changeID,
+		baseBranch:        cfg.baseBranch,
+		tip:               cfg.tip,
+		coverLetter:       coverLetter,
+		coverLetterMode:   coverLetterMode,
+		subjectPrefix:     cfg.subjectPrefix,
+		inReplyTo:         cfg.inReplyTo,
+		sentVersions:      sentVersions,
+		inReplyToPrev:     !cfg.noInReplyToPrev,
+		rangeDiff:         true,
+		dryRun:            flags.dryRun,
+		output:            flags.output,
+		loadingMsg:        "Loading submission...",
 	}.setState(state)
 }
 
+// newAddressInput creates a text input for a comma-separated address list,
+// with completion.
+func newAddressInput(prompt string) textinput.Model {
+	input := textinput.New()
+	input.Prompt = prompt
+	input.PromptStyle = labelStyle.Copy()
+	input.TextStyle = textStyle.Copy()
+	input.ShowSuggestions = true
+	// Up and down are used to move between fields
+	input.KeyMap.NextSuggestion = key.NewBinding(key.WithKeys("ctrl+n"))
+	input.KeyMap.PrevSuggestion = key.NewBinding(key.WithKeys("ctrl+p"))
+	return input
+}
+
 func (m submitModel) Init() tea.Cmd {
-	return tea.Batch(m.spinner.Tick, textinput.Blink, func() tea.Msg {
+	cmds := []tea.Cmd{m.spinner.Tick, textinput.Blink, func() tea.Msg {
 		return <-m.progress
 	}, func() tea.Msg {
-		return loadSubmissionLog(m.ctx, m.baseBranch, m.headBranch)
-	})
+		// Suggestions are best-effort, e.g. there may be no commits yet
+		addrs, _ := loadGitLogAddresses(m.ctx)
+		return logAddressesLoaded{addrs}
+	}}
+	if m.baseBranch != "" {
+		cmds = append(cmds, func() tea.Msg {
+			return loadSubmissionLog(m.ctx, m.baseBranch, m.tip, m.headBranch, m.changeID, m.identity)
+		})
+	} else {
+		cmds = append(cmds, func() tea.Msg {
+			candidates, err := listGitBaseBranchCandidates(m.ctx, m.headBranch)
+			if err != nil {
+				return err
+			} else if len(candidates) == 0 {
+				return fmt.Errorf("failed to find base branch")
+			}
+			return baseBranchCandidatesLoaded{candidates}
+		})
+	}
+	if m.resuming {
+		cmds = append(cmds, m.resume())
+	}
+	return tea.Batch(cmds...)
 }
 
 func (m submitModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.sending && (msg.Type == tea.KeyCtrlC || msg.Type == tea.KeyEsc) {
+			if m.cancelled {
+				return m, tea.Quit
+			}
+			// Mails which have already been sent are recorded in the
+			// outbox, the submission can be resumed later
+			m.cancelled = true
+			m.cancelSend()
+			m.loadingMsg = "Cancelling submission..."
+			return m, nil
+		}
 		if msg.Type != tea.KeyCtrlC && m.loadingMsg != "" {
 			break
 		}
+		if m.previewTitle != "" {
+			switch msg.String() {
+			case "esc", "q", "enter":
+				m.previewTitle = ""
+				return m, nil
+			case "ctrl+c":
+				return m, tea.Quit
+			}
+			m.preview, cmd = m.preview.Update(msg)
+			return m, cmd
+		}
+		if m.editingCoverLetter {
+			return m.updateCoverLetterEditor(msg)
+		}
+		if m.outbox != nil && !m.resuming {
+			switch msg.String() {
+			case "enter":
+				m.resuming = true
+				m.sending = true
+				m.loadingMsg = "Resuming submission..."
+				return m, m.resume()
+			case "d":
+				if err := m.outbox.remove(); err != nil {
+					return m, func() tea.Msg { return err }
+				}
+				m.outbox = nil
+				return m, nil
+			case "ctrl+c", "esc":
+				return m, tea.Quit
+			}
+			break
+		}
+		if m.pickingBaseBranch() {
+			switch msg.Type {
+			case tea.KeyUp:
+				if m.baseCursor > 0 {
+					m.baseCursor--
+				}
+			case tea.KeyDown:
+				if m.baseCursor < len(m.baseCandidates)-1 {
+					m.baseCursor++
+				}
+			case tea.KeyEnter:
+				return m.pickBaseBranch(m.baseCandidates[m.baseCursor].Name)
+			case tea.KeyCtrlC, tea.KeyEsc:
+				return m, tea.Quit
+			}
+			return m, nil
+		}
 		switch msg.Type {
 		case tea.KeyEnter:
 			switch m.state {
-			case submitStateTo, submitStateVersion:
+			case submitStateIdentity:
+				return m.switchIdentity()
+			case submitStateBase, submitStateTo, submitStateCc, submitStateVersion:
 				m = m.setState(submitStateConfirm)
+			case submitStateInReplyToPrev:
+				m.inReplyToPrev = !m.inReplyToPrev
+			case submitStateRangeDiff:
+				m.rangeDiff = !m.rangeDiff
 			case submitStateCoverLetter:
 				if m.headBranch == "" {
 					break
 				}
-				cmd := exec.Command("git", "branch", "--edit-description", m.headBranch)
-				return m, tea.ExecProcess(cmd, func(err error) tea.Msg {
-					if err != nil {
-						return err
-					}
-					coverLetter, err := loadGitBranchDescription(m.headBranch)
-					if err != nil {
-						return err
-					} else {
-						return coverLetterUpdated{coverLetter}
-					}
-				})
+				return m.editCoverLetter()
 			case submitStateConfirm:
-				if !m.canSubmit() {
+				if !m.canSend() {
 					break
 				}
+				if m.dryRun {
+					return m.save()
+				}
 				m.loadingMsg = "Submitting patches..."
+				m.sending = true
+				// The checks are run again before sending, any pending
+				// result is stale
+				m.validationGen++
+				gen := m.validationGen
 				return m, func() tea.Msg {
-					to, err := parseAddressList(m.to.Value())
+					cfg, err := m.submissionConfig()
 					if err != nil {
 						return err
 					}
-
-					cfg := submissionConfig{
-						to:            to,
-						baseBranch:    m.baseBranch,
-						rerollCount:   m.version.Value(),
-						subjectPrefix: m.subjectPrefix,
+					msg := submitPatches(m.sendCtx, m.headBranch, cfg, m.gitConfig, m.coverLetter, m.validator, m.progress)
+					// The mails sent may differ from the ones checked earlier,
+					// e.g. if the version has changed since
+					var validationErr *validationError
+					if err, ok := msg.(error); ok && errors.As(err, &validationErr) {
+						return validationDone{gen: gen, failures: validationErr.failures}
 					}
-					return submitPatches(m.ctx, m.headBranch, &cfg, m.gitConfig, m.coverLetter != "", m.progress)
+					return msg
+				}
+			case submitStateSave:
+				if !m.canSubmit() {
+					break
+				}
+				return m.save()
+			case submitStateCommits:
+				if !m.checkForm() {
+					break
+				}
+				commit := m.commits[m.commitCursor].Hash
+				m.loadingMsg = "Preparing preview..."
+				return m, func() tea.Msg {
+					return m.loadPreview(commit)
+				}
+			}
+		case tea.KeySpace:
+			switch m.state {
+			case submitStateIdentity:
+				return m.switchIdentity()
+			case submitStateInReplyToPrev:
+				m.inReplyToPrev = !m.inReplyToPrev
+			case submitStateRangeDiff:
+				m.rangeDiff = !m.rangeDiff
+			case submitStateCommits:
+				// Only send the selected commit and the older ones
+				if m.commitCursor > 0 {
+					value := formatGitRevRange(m.baseBranch, m.commits[m.commitCursor].Hash[:12])
+					m.base.SetValue(value)
+					return m.setBase(value)
 				}
 			}
 		case tea.KeyUp:
-			if m.state > 0 {
-				m = m.setState(m.state - 1)
+			if m.state == submitStateCommits && m.commitCursor > 0 {
+				m = m.moveCommitCursor(-1)
+			} else {
+				m = m.moveState(-1)
 			}
 		case tea.KeyDown:
-			if m.state < submitStateConfirm {
-				m = m.setState(m.state + 1)
+			if m.state == submitStateCommits {
+				m = m.moveCommitCursor(1)
+			} else {
+				m = m.moveState(1)
+			}
+		case tea.KeyPgUp:
+			if m.state == submitStateCommits {
+				m = m.moveCommitCursor(-commitListHeight)
+			}
+		case tea.KeyPgDown:
+			if m.state == submitStateCommits {
+				m = m.moveCommitCursor(commitListHeight)
+			}
+		case tea.KeyCtrlR:
+			if m.validator != nil && !m.validating {
+				return m.startValidation()
 			}
 		case tea.KeyCtrlC, tea.KeyEsc:
 			return m, tea.Quit
@@ -249,19 +700,123 @@ func (m submitModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case spinner.TickMsg:
 		m.spinner, cmd = m.spinner.Update(msg)
 		return m, cmd
-	case submissionLog:
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.preview.Width, m.preview.Height = previewSize(msg.Width, msg.Height)
+		m = m.resizeCoverLetterEditor()
+	case patchPreview:
 		m.loadingMsg = ""
+		m.previewTitle = msg.title
+		m.preview = viewport.New(previewSize(m.width, m.height))
+		m.preview.SetContent(msg.content)
+		return m, nil
+	case submissionLog:
+		if msg.revRange != m.revRange() {
+			return m, nil
+		}
+		if !m.resuming {
+			m.loadingMsg = ""
+		}
+		m.loadingLog = false
+		m.coverLetter = msg.coverLetter
+		m.coverCommit = msg.coverCommit
 		m.commits = msg.commits
+		m.commitCc = msg.commitCc
+		m.commitMaintainers = msg.commitMaintainers
+		m.commitCmds = msg.commitCmds
+		m.stack = msg.stack
+		m.commitCursor, m.commitOffset = 0, 0
 		m.sameAsPrevSubmission = msg.sameAsPrevSubmission
+		m.logWarnings = msg.warnings
+		var cmds []tea.Cmd
+		if len(m.commits) > 0 {
+			m.linting = true
+			cmds = append(cmds, m.lint())
+		}
+		// The checks need the cover letter, only known now
+		if m.validator != nil {
+			m, cmd = m.startValidation()
+			cmds = append(cmds, cmd)
+		}
+		return m, tea.Batch(cmds...)
+	case identitySwitched:
+		m.loadingMsg = ""
+		m.identity = msg.identity
+		m.gitConfig = msg.gitConfig
+		m.from = msg.from
+		m.aliases = msg.aliases
+		// Replace the recipients of the previous identity, unless edited
+		if strings.TrimSpace(m.to.Value()) == msg.prevTo {
+			m.to.SetValue(msg.to)
+		}
+		if strings.TrimSpace(m.cc.Value()) == msg.prevCc {
+			m.cc.SetValue(msg.cc)
+		}
+		// Recipients collected from commits depend on the identity
+		return m, func() tea.Msg {
+			return loadSubmissionLog(m.ctx, m.baseBranch, m.tip, m.headBranch, m.changeID, m.identity)
+		}
+	case logAddressesLoaded:
+		m.logAddrs = msg.addrs
+		return m, nil
+	case baseBranchCandidatesLoaded:
+		m.loadingMsg = ""
+		m.baseCandidates = msg.candidates
+		return m, nil
+	case baseEdited:
+		if msg.value != m.base.Value() {
+			// The user is still typing
+			return m, nil
+		}
+		return m.setBase(msg.value)
+	case lintDone:
+		if msg.revRange != m.revRange() {
+			return m, nil
+		}
+		m.linting = false
+		m.lintWarnings = msg.warnings
+		return m, nil
+	case validationDone:
+		if msg.gen != m.validationGen {
+			return m, nil
+		}
+		if m.sending {
+			// Validation failed right before sending
+			m.sending = false
+			m.loadingMsg = ""
+		}
+		m.validating = false
+		m.validationFailures = msg.failures
+		return m, nil
+	case coverLetterEdited:
+		m.coverLetterEditor.SetValue(strings.TrimRight(msg.coverLetter, "\n"))
+		return m, nil
 	case coverLetterUpdated:
 		m.coverLetter = msg.coverLetter
+		if msg.rewritten {
+			// The commits have changed
+			return m.reloadLog()
+		}
+		if m.validator != nil && !m.validating {
+			return m.startValidation()
+		}
+	case submissionExported:
+		m.loadingMsg = ""
+		m.exported = &msg
+		if m.dryRun {
+			m.done = true
+			return m, tea.Quit
+		}
 	case submissionProgress:
+		m.sendProgress = msg
 		if msg.done {
 			m.loadingMsg = ""
 			m.done = true
 			return m, tea.Quit
 		} else {
-			if msg.mailsSent == 0 && msg.mailsTotal == 1 {
+			if m.cancelled {
+				// Keep the cancellation message
+			} else if msg.mailsSent == 0 && msg.mailsTotal == 1 {
 				m.loadingMsg = fmt.Sprintf("Sending mail...")
 			} else if msg.mailsSent < msg.mailsTotal {
 				m.loadingMsg = fmt.Sprintf("Sending mail %v/%v...", msg.mailsSent+1, msg.mailsTotal)
@@ -275,13 +830,30 @@ func (m submitModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case error:
 		m.loadingMsg = ""
 		m.errMsg = msg.Error()
+		if m.cancelled && errors.Is(msg, context.Canceled) {
+			m.errMsg = "Submission cancelled"
+		}
+		if p := m.sendProgress; m.sending && p.mailsTotal > 0 {
+			m.errMsg += fmt.Sprintf(": %v/%v mails sent, run pyonji again to send the rest", p.mailsSent, p.mailsTotal)
+		}
 		return m, tea.Quit
 	}
 
-	var toCmd, versionCmd tea.Cmd
+	var baseCmd, toCmd, ccCmd, versionCmd, editorCmd tea.Cmd
+	prevBase := m.base.Value()
+	m.base, baseCmd = m.base.Update(msg)
+	if value := m.base.Value(); value != prevBase {
+		baseCmd = tea.Batch(baseCmd, tea.Tick(baseEditDelay, func(time.Time) tea.Msg {
+			return baseEdited{value}
+		}))
+	}
 	m.to, toCmd = m.to.Update(msg)
+	m.cc, ccCmd = m.cc.Update(msg)
 	m.version, versionCmd = m.version.Update(msg)
-	return m, tea.Batch(toCmd, versionCmd)
+	m.coverLetterEditor, editorCmd = m.coverLetterEditor.Update(msg)
+	m.to.SetSuggestions(addressSuggestions(m.to.Value(), m.aliases, m.logAddrs))
+	m.cc.SetSuggestions(addressSuggestions(m.cc.Value(), m.aliases, m.logAddrs))
+	return m, tea.Batch(baseCmd, toCmd, ccCmd, versionCmd, editorCmd)
 }
 
 func (m submitModel) View() string {
@@ -289,199 +861,1031 @@ func (m submitModel) View() string {
 		return m.spinner.View() + m.loadingMsg + "\n"
 	}
 
+	if m.previewTitle != "" {
+		title := m.previewTitle + " " + labelStyle.Render("Press Esc to close the preview")
+		return title + "\n\n" + m.preview.View()
+	}
+
 	var sb strings.Builder
 
-	field := formField{Label: "Base", Text: m.baseBranch}
-	sb.WriteString(field.View() + "\n")
+	if m.pickingBaseBranch() {
+		sb.WriteString("The base branch couldn't be detected, please pick one:\n\n")
+		start := m.baseCursor - commitListHeight + 1
+		if start < 0 {
+			start = 0
+		}
+		end := start + commitListHeight
+		if end > len(m.baseCandidates) {
+			end = len(m.baseCandidates)
+		}
+		for i := start; i < end; i++ {
+			candidate := m.baseCandidates[i]
+			cursor, name := "  ", candidate.Name
+			if i == m.baseCursor {
+				cursor, name = activeLabelStyle.Render("> "), activeTextStyle.Render(name)
+			}
+			sb.WriteString(cursor + name + " " + labelStyle.Render(pluralize("commit", candidate.Distance)) + "\n")
+		}
+		if m.errMsg != "" {
+			sb.WriteString(errorStyle.Render("× " + m.errMsg + "\n"))
+		}
+		return lipgloss.NewStyle().Padding(1).Render(sb.String())
+	}
+
+	if len(m.identities) > 0 {
+		identity := m.identity
+		if identity == "" {
+			identity = "default"
+		}
+		if m.from != nil {
+			identity += " " + labelStyle.Render("<"+m.from.Address+">")
+		}
+		field := formField{Label: "Identity", Text: identity, Active: m.state == submitStateIdentity}
+		sb.WriteString(field.View() + "\n")
+	}
+
+	sb.WriteString(m.base.View())
+	if m.baseInvalid {
+		sb.WriteString(" " + errorStyle.Render("× unknown revision"))
+	}
+	sb.WriteString("\n")
+
+	if len(m.stack) > 0 {
+		var deps []string
+		for _, parent := range m.stack {
+			dep := parent.Branch
+			if parent.Version != nil {
+				dep += " v" + parent.Version.Version
+			} else {
+				dep += " (not sent)"
+			}
+			deps = append(deps, dep)
+		}
+		field := formField{Label: "Depends on", Text: strings.Join(deps, ", ")}
+		sb.WriteString(field.View() + "\n")
+	}
 
 	sb.WriteString(m.to.View() + "\n")
+	sb.WriteString(m.cc.View() + "\n")
 	sb.WriteString(m.version.View() + "\n")
 
+	if m.inReplyTo != "" {
+		field := formField{Label: "In reply to", Text: "<" + m.inReplyTo + ">"}
+		sb.WriteString(field.View() + "\n")
+	} else if prev := m.prevVersion(); prev != nil {
+		field := formField{
+			Label:  "In reply to v" + prev.Version,
+			Text:   checkbox(m.inReplyToPrev),
+			Active: m.state == submitStateInReplyToPrev,
+		}
+		sb.WriteString(field.View() + "\n")
+	}
+
+	if prev := m.prevVersion(); prev != nil && prev.Tip != "" {
+		label := "Range-diff against v" + prev.Version
+		if len(m.commits) == 1 {
+			label = "Interdiff against v" + prev.Version
+		}
+		text := checkbox(m.rangeDiff)
+		if !m.canRangeDiff() {
+			if prev.gone {
+				text = "unavailable (previous commits are gone)"
+			} else {
+				text = "needs a cover letter"
+			}
+		}
+		field := formField{Label: label, Text: text, Active: m.state == submitStateRangeDiff}
+		sb.WriteString(field.View() + "\n")
+	}
+
+	if m.editingCoverLetter {
+		sb.WriteString(m.coverLetterEditorView())
+		if m.errMsg != "" {
+			sb.WriteString(errorStyle.Render("× " + m.errMsg + "\n"))
+		}
+		return lipgloss.NewStyle().Padding(1).Render(sb.String())
+	}
+
 	var coverLetter string
-	if m.coverLetter != "" {
-		coverLetter, _, _ = strings.Cut(m.coverLetter, "\n")
-		coverLetter = truncate.StringWithTail(coverLetter, 72, "...")
+	if subject, _ := splitCoverLetter(m.coverLetter); subject != "" {
+		coverLetter = truncate.StringWithTail(subject, 72, "...")
 	} else {
 		coverLetter = "none"
 	}
-	field = formField{Label: "Cover letter", Text: coverLetter, Active: m.state == submitStateCoverLetter}
-	sb.WriteString(field.View() + "\n")
-
-	sb.WriteString("\n")
-
-	if m.sameAsPrevSubmission {
-		sb.WriteString(warningStyle.Render("⚠ This version has already been submitted") + "\n\n")
+	field := formField{Label: "Cover letter", Text: coverLetter, Active: m.state == submitStateCoverLetter}
+	sb.WriteString(field.View())
+	if m.coverCommit != nil {
+		sb.WriteString(" " + labelStyle.Render("in commit "+m.coverCommit.Hash[:12]))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("\n")
+
+	var warnings []string
+	if m.sameAsPrevSubmission {
+		warnings = append(warnings, "This version has already been submitted")
+	}
+	warnings = append(warnings, m.logWarnings...)
+	warnings = append(warnings, m.lintWarnings...)
+	for _, warning := range warnings {
+		sb.WriteString(warningStyle.Render("⚠ "+warning) + "\n")
+	}
+	if len(warnings) > 0 {
+		sb.WriteString("\n")
+	}
+
+	if m.loadingMsg != "" {
+		sb.WriteString(m.spinner.View() + m.loadingMsg + "\n")
+	} else if m.done && m.dryRun {
+		sb.WriteString(successStyle.Render(fmt.Sprintf("✓ Saved %v to %v\n", pluralize("mail", m.exported.mailsSent), m.exported.path)))
+	} else if m.done {
+		sb.WriteString(successStyle.Render("✓ Patches sent\n"))
+		for _, warning := range m.sendProgress.warnings {
+			sb.WriteString(warningStyle.Render("⚠ "+warning) + "\n")
+		}
+	} else if m.outbox != nil && !m.resuming {
+		warning := fmt.Sprintf("⚠ A previous submission was interrupted (%v/%v mails sent)", m.outbox.sentCount(), len(m.outbox.Messages))
+		if m.outbox.Branch != m.headBranch {
+			warning = fmt.Sprintf("⚠ A previous submission of branch %q was interrupted (%v/%v mails sent)", m.outbox.Branch, m.outbox.sentCount(), len(m.outbox.Messages))
+		}
+		sb.WriteString(warningStyle.Render(warning) + "\n\n")
+		btn := button{Label: "Resume", Active: true}
+		sb.WriteString(btn.View() + " " + labelStyle.Render("or press d to discard it") + "\n")
+	} else {
+		label := "Submit"
+		if m.dryRun {
+			label = "Submit (dry run)"
+		}
+		submitBtn := button{
+			Label:    label,
+			Active:   m.state == submitStateConfirm,
+			Disabled: !m.canSend(),
+		}
+		saveBtn := button{
+			Label:    "Save to mbox",
+			Active:   m.state == submitStateSave,
+			Disabled: !m.canSubmit(),
+		}
+		sb.WriteString(submitBtn.View() + " " + saveBtn.View() + "\n")
+		if m.exported != nil {
+			sb.WriteString(successStyle.Render(fmt.Sprintf("✓ Saved %v to %v", pluralize("mail", m.exported.mailsSent), m.exported.path)) + "\n")
+		}
+		if m.validating {
+			sb.WriteString(labelStyle.Render("Running checks...") + "\n")
+		} else if len(m.validationFailures) > 0 {
+			for _, failure := range m.validationFailures {
+				sb.WriteString("\n" + errorStyle.Render("× Check failed: "+failure.Name) + "\n")
+				sb.WriteString(labelStyle.Render(truncateLines(failure.Output, validationOutputLines)) + "\n")
+			}
+			sb.WriteString("\n" + labelStyle.Render("Press Ctrl-R to run the checks again") + "\n")
+		}
+	}
+
+	sb.WriteString("\n")
+
+	if m.loadingLog && m.loadingMsg == "" {
+		sb.WriteString(m.spinner.View() + "Loading commits...\n")
+	} else if len(m.commits) > 0 {
+		sb.WriteString(pluralize("commit", len(m.commits)) + "\n")
+
+		if m.commitOffset > 0 {
+			sb.WriteString(labelStyle.Render(fmt.Sprintf("  ↑ %v more", m.commitOffset)) + "\n")
+		}
+
+		end := m.commitOffset + commitListHeight
+		if end > len(m.commits) {
+			end = len(m.commits)
+		}
+		for i := m.commitOffset; i < end; i++ {
+			commit := m.commits[i]
+			hash := commit.Hash[:12]
+
+			cursor, subject := "  ", commit.Subject
+			if m.state == submitStateCommits && i == m.commitCursor {
+				cursor, subject = activeLabelStyle.Render("> "), activeTextStyle.Render(subject)
+			}
+			sb.WriteString(cursor + hashStyle.Render(hash) + " " + subject + "\n")
+
+			indent := strings.Repeat(" ", lipgloss.Width(cursor)+len(hash)+1)
+			if res := m.commitCmds[commit.Hash]; res != nil && len(res.To) > 0 {
+				sb.WriteString(indent + labelStyle.Render("To "+formatAddressList(res.To)) + "\n")
+			}
+			if cc := m.commitCc[commit.Hash]; len(cc) > 0 {
+				sb.WriteString(indent + labelStyle.Render("Cc "+formatAddressList(cc)) + "\n")
+			}
+			if sections := m.commitMaintainers[commit.Hash]; len(sections) > 0 {
+				sb.WriteString(indent + labelStyle.Render("Maintainers "+formatMaintainersSections(sections)) + "\n")
+			}
+			if res := m.commitCmds[commit.Hash]; res != nil {
+				for _, field := range res.Header {
+					sb.WriteString(indent + labelStyle.Render(field.Key+": "+field.Value) + "\n")
+				}
+			}
+		}
+
+		if n := len(m.commits) - end; n > 0 {
+			sb.WriteString(labelStyle.Render(fmt.Sprintf("  ↓ %v more", n)) + "\n")
+		}
+		if m.state == submitStateCommits {
+			hint := "Press Enter to preview the mail"
+			if m.commitCursor > 0 {
+				hint += ", Space to only send up to this commit"
+			}
+			sb.WriteString(labelStyle.Render(hint) + "\n")
+		}
+	} else if m.errMsg == "" {
+		sb.WriteString(warningStyle.Render("⚠ There are no changes\n"))
+	}
+
+	if m.errMsg != "" {
+		sb.WriteString(errorStyle.Render("× " + m.errMsg + "\n"))
+	}
+
+	return lipgloss.NewStyle().Padding(1).Render(sb.String())
+}
+
+// pickingBaseBranch returns true if the user needs to pick the base branch.
+func (m submitModel) pickingBaseBranch() bool {
+	return m.baseBranch == "" && len(m.baseCandidates) > 0 && m.outbox == nil && !m.resuming
+}
+
+func (m submitModel) pickBaseBranch(name string) (tea.Model, tea.Cmd) {
+	m.base.SetValue(name)
+	m.loadingMsg = "Loading submission..."
+	return m.setBase(name)
+}
+
+// setBase changes the range of commits to send from the value of the base
+// field, and reloads the commits.
+func (m submitModel) setBase(value string) (submitModel, tea.Cmd) {
+	base, tip := parseGitRevRange(value)
+	m.baseInvalid = !checkGitRevRange(base, tip)
+	if m.baseInvalid || (base == m.baseBranch && tip == m.tip) {
+		return m, nil
+	}
+
+	m.baseBranch, m.tip = base, tip
+	return m.reloadLog()
+}
+
+func (m submitModel) reloadLog() (submitModel, tea.Cmd) {
+	m.loadingLog = true
+	m.linting = false
+	m.lintWarnings = nil
+	m.validationFailures = nil
+	// The checks are started again once the commits are loaded
+	m.validating = m.validator != nil
+	m.validationGen++
+	return m, func() tea.Msg {
+		return loadSubmissionLog(m.ctx, m.baseBranch, m.tip, m.headBranch, m.changeID, m.identity)
+	}
+}
+
+func (m submitModel) revRange() string {
+	return m.baseBranch + ".." + m.tip
+}
+
+func (m submitModel) setState(state submitState) submitModel {
+	m.base.Blur()
+	m.base.PromptStyle = labelStyle
+	m.base.TextStyle = textStyle
+
+	m.to.Blur()
+	m.to.PromptStyle = labelStyle
+	m.to.TextStyle = textStyle
+
+	m.cc.Blur()
+	m.cc.PromptStyle = labelStyle
+	m.cc.TextStyle = textStyle
+
+	m.version.Blur()
+	m.version.PromptStyle = labelStyle
+	m.version.TextStyle = textStyle
+
+	m.state = state
+	switch state {
+	case submitStateBase:
+		m.base.Focus()
+		m.base.PromptStyle = activeLabelStyle
+		m.base.TextStyle = activeTextStyle
+	case submitStateTo:
+		m.to.Focus()
+		m.to.PromptStyle = activeLabelStyle
+		m.to.TextStyle = activeTextStyle
+	case submitStateCc:
+		m.cc.Focus()
+		m.cc.PromptStyle = activeLabelStyle
+		m.cc.TextStyle = activeTextStyle
+	case submitStateVersion:
+		m.version.Focus()
+		m.version.PromptStyle = activeLabelStyle
+		m.version.TextStyle = activeTextStyle
+	}
+	return m
+}
+
+func (m submitModel) moveState(delta int) submitModel {
+	state := m.state
+	for {
+		state += submitState(delta)
+		if state < 0 || state > submitStateCommits {
+			return m
+		}
+		if m.hasState(state) {
+			return m.setState(state)
+		}
+	}
+}
+
+func (m submitModel) hasState(state submitState) bool {
+	switch state {
+	case submitStateIdentity:
+		return len(m.identities) > 0
+	case submitStateInReplyToPrev:
+		return m.inReplyTo == "" && m.prevVersion() != nil
+	case submitStateRangeDiff:
+		return m.canRangeDiff()
+	case submitStateCommits:
+		return len(m.commits) > 0
+	default:
+		return true
+	}
+}
+
+func (m submitModel) moveCommitCursor(delta int) submitModel {
+	m.commitCursor += delta
+	if m.commitCursor >= len(m.commits) {
+		m.commitCursor = len(m.commits) - 1
+	}
+	if m.commitCursor < 0 {
+		m.commitCursor = 0
+	}
+
+	if m.commitCursor < m.commitOffset {
+		m.commitOffset = m.commitCursor
+	} else if m.commitCursor >= m.commitOffset+commitListHeight {
+		m.commitOffset = m.commitCursor - commitListHeight + 1
+	}
+	return m
+}
+
+// submissionConfig builds the submission configuration from the form.
+func (m submitModel) submissionConfig() (*submissionConfig, error) {
+	to, err := parseAddressList(m.aliases.expand(m.to.Value()))
+	if err != nil {
+		return nil, err
+	}
+	cc, err := parseAddressList(m.aliases.expand(m.cc.Value()))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := submissionConfig{
+		identity:      m.identity,
+		to:            to,
+		cc:            cc,
+		baseBranch:    m.baseBranch,
+		tip:           m.tip,
+		coverCommit:   m.coverCommitHash(),
+		changeID:      m.changeID,
+		rerollCount:   m.version.Value(),
+		subjectPrefix: m.subjectPrefix,
+		inReplyTo:     m.inReplyTo,
+	}
+	if prev := m.prevVersion(); cfg.inReplyTo == "" && prev != nil && m.inReplyToPrev {
+		cfg.inReplyTo = prev.MessageID
+	}
+	if m.canRangeDiff() && m.rangeDiff {
+		cfg.rangeDiff = m.prevVersion()
+	}
+	return &cfg, nil
+}
+
+// loadPreview prepares the submission and renders the mail which would be
+// sent for the specified commit.
+func (m submitModel) loadPreview(commit string) tea.Msg {
+	cfg, err := m.submissionConfig()
+	if err != nil {
+		return err
+	}
+	_, patches, err := prepareSubmission(m.ctx, m.headBranch, cfg, m.coverLetter)
+	if err != nil {
+		return err
+	}
+	for i := range patches {
+		if patches[i].commit == commit {
+			return patchPreview{title: hashStyle.Render(commit[:12]), content: renderPatchPreview(&patches[i])}
+		}
+	}
+	// git format-patch skips merge commits
+	return patchPreview{title: hashStyle.Render(commit[:12]), content: warningStyle.Render("⚠ This commit won't be sent")}
+}
+
+func previewSize(width, height int) (int, int) {
+	// Leave room for the title
+	height -= 2
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+func (m submitModel) prevVersion() *sentVersion {
+	return findPrevVersion(m.sentVersions, m.version.Value())
+}
+
+func (m submitModel) canRangeDiff() bool {
+	return canRangeDiff(m.prevVersion(), len(m.commits), m.coverLetter != "")
+}
+
+func (m submitModel) save() (tea.Model, tea.Cmd) {
+	path := m.output
+	if path == "" {
+		path = defaultMboxPath(m.headBranch, m.version.Value())
+	}
+
+	m.loadingMsg = "Saving patches..."
+	return m, func() tea.Msg {
+		cfg, err := m.submissionConfig()
+		if err != nil {
+			return err
+		}
+		n, err := exportSubmission(m.ctx, m.headBranch, cfg, m.coverLetter, path)
+		if err != nil {
+			return err
+		}
+		return submissionExported{path: path, mailsSent: n}
+	}
+}
+
+func (m submitModel) resume() tea.Cmd {
+	return func() tea.Msg {
+		gitConfig, err := m.outbox.loadSendEmailConfig(m.identity, m.gitConfig)
+		if err != nil {
+			return err
+		}
+		return sendOutbox(m.sendCtx, m.outbox, gitConfig, m.progress)
+	}
+}
+
+// switchIdentity moves to the next sendemail identity, the default one being
+// last.
+func (m submitModel) switchIdentity() (tea.Model, tea.Cmd) {
+	identity := ""
+	for i, name := range m.identities {
+		if m.identity == "" {
+			identity = m.identities[0]
+			break
+		} else if name == m.identity && i+1 < len(m.identities) {
+			identity = m.identities[i+1]
+			break
+		}
+	}
+
+	m.loadingMsg = "Switching identity..."
+	return m, func() tea.Msg {
+		gitConfig, err := loadGitSendEmailConfig(identity)
+		if err != nil {
+			return err
+		}
+		if gitConfig == nil {
+			// Keep using the mail server set up on first run
+			gitConfig = m.gitConfig
+		} else if smtpConfig := gitConfig.SMTP; smtpConfig != nil && smtpConfig.needsPassword() && !m.dryRun {
+			// The terminal is used by the TUI, don't let Git prompt
+			if err := smtpConfig.fillCredential(false); err != nil {
+				return fmt.Errorf("failed to get password for identity %q (run pyonji --identity %v to enter it): %v", identity, identity, err)
+			}
+		}
+
+		from, err := loadGitSendEmailFrom(identity)
+		if err != nil {
+			return err
+		}
+		aliases, err := loadAddressAliases(identity)
+		if err != nil {
+			return err
+		}
+
+		msg := identitySwitched{identity: identity, gitConfig: gitConfig, from: from, aliases: aliases}
+		defaults := []struct {
+			identity string
+			to, cc   *string
+		}{
+			{m.identity, &msg.prevTo, &msg.prevCc},
+			{identity, &msg.to, &msg.cc},
+		}
+		for _, d := range defaults {
+			to, err := loadGitSendEmailTo(d.identity)
+			if err != nil {
+				return err
+			}
+			cc, err := loadGitSendEmailCc(d.identity)
+			if err != nil {
+				return err
+			}
+			*d.to, *d.cc = formatAddressList(to), formatAddressList(cc)
+		}
+		return msg
+	}
+}
+
+// lint checks the series for common mistakes. The checks are advisory, so
+// failing to run them is reported as a warning rather than an error.
+func (m submitModel) lint() tea.Cmd {
+	return func() tea.Msg {
+		options := gitFormatPatchOptions{CoverCommit: m.coverCommitHash()}
+		patches, err := formatGitPatches(m.ctx, m.baseBranch, m.tip, &options)
+		if err != nil {
+			return lintDone{revRange: m.revRange(), warnings: []string{lintFailureWarning(err)}}
+		}
+		warnings, err := lintSeries(m.ctx, m.baseBranch, m.tip, m.commits, patches, m.from)
+		if err != nil {
+			warnings = append(warnings, lintFailureWarning(err))
+		}
+		return lintDone{revRange: m.revRange(), warnings: warnings}
+	}
+}
+
+// startValidation runs the checks in the background.
+func (m submitModel) startValidation() (submitModel, tea.Cmd) {
+	m.validating = true
+	m.validationGen++
+	return m, m.validate()
+}
+
+func (m submitModel) validate() tea.Cmd {
+	gen := m.validationGen
+	options := gitFormatPatchOptions{
+		RerollCount:   m.version.Value(),
+		CoverLetter:   m.coverLetter,
+		SubjectPrefix: m.subjectPrefix,
+		CoverCommit:   m.coverCommitHash(),
+	}
+	return func() tea.Msg {
+		stack, err := loadSeriesStack(m.baseBranch)
+		if err != nil {
+			return err
+		}
+		stack.setFormatPatchOptions(&options)
+		patches, err := formatGitPatches(m.ctx, m.baseBranch, m.tip, &options)
+		if err != nil {
+			return err
+		}
+		var validationErr *validationError
+		if err := m.validator.validate(m.ctx, patches); errors.As(err, &validationErr) {
+			return validationDone{gen: gen, failures: validationErr.failures}
+		} else if err != nil {
+			return err
+		}
+		return validationDone{gen: gen}
+	}
+}
+
+func (m submitModel) coverCommitHash() string {
+	if m.coverCommit == nil {
+		return ""
+	}
+	return m.coverCommit.Hash
+}
+
+// Maximum number of lines of check output displayed
+const validationOutputLines = 10
+
+func truncateLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return strings.Join(lines[:n], "\n") + fmt.Sprintf("\n(%v more lines)", len(lines)-n)
+}
+
+// canSend is like canSubmit, but also requires the series to be linted and the
+// checks to pass.
+func (m submitModel) canSend() bool {
+	if m.linting {
+		return false
+	}
+	if m.validator != nil && (m.validating || len(m.validationFailures) > 0) {
+		return false
+	}
+	return m.canSubmit()
+}
+
+// checkForm checks whether the fields of the form are valid.
+func (m submitModel) checkForm() bool {
+	return checkAddressList(m.aliases.expand(m.to.Value())) && checkAddressList(m.aliases.expand(m.cc.Value())) && checkVersion(m.version.Value())
+}
+
+func (m submitModel) canSubmit() bool {
+	if m.loadingLog || m.baseInvalid {
+		return false
+	}
+	return validateSubmission(m.commits, m.aliases.expand(m.to.Value()), m.aliases.expand(m.cc.Value()), m.version.Value()) == nil
+}
+
+// validateSubmission checks whether a submission can be sent.
+func validateSubmission(commits []logCommit, to, cc, version string) error {
+	if len(commits) == 0 {
+		return fmt.Errorf("there are no changes")
+	}
+	if !checkAddressList(to) {
+		return fmt.Errorf("invalid To address list")
+	}
+	if !checkAddressList(cc) {
+		return fmt.Errorf("invalid Cc address list")
+	}
+	if !checkVersion(version) {
+		return fmt.Errorf("invalid version")
+	}
+	return nil
+}
+
+// loadSubmissionLog loads the commits between baseBranch and tip, and the
+// recipients of each of them. An empty tip means HEAD.
+func loadSubmissionLog(ctx context.Context, baseBranch, tip, headBranch, changeID, identity string) tea.Msg {
+	revRange := baseBranch + ".." + tip
+	commits, err := loadGitLog(ctx, revRange)
+	if err != nil {
+		return err
+	}
+
+	stack, err := loadSeriesStack(baseBranch)
+	if err != nil {
+		return err
+	}
+
+	// The cover letter commit isn't sent as a patch
+	coverLetter, coverCommit, err := loadSeriesCoverLetter(headBranch, commits)
+	if err != nil {
+		return err
+	}
+	if coverCommit != nil {
+		commits = commits[:len(commits)-1]
+	}
+
+	sameAsPrevSubmission := false
+	if len(commits) > 0 {
+		last := getLastSentHash(headBranch, changeID)
+		sameAsPrevSubmission = last != "" && last == commits[0].Hash
+	}
+
+	from, err := loadGitSendEmailFrom(identity)
+	if err != nil {
+		return err
+	}
+	policy, err := loadCcPolicy(identity, from)
+	if err != nil {
+		return err
+	}
+	ms, err := loadMaintainersSuggestions()
+	if err != nil {
+		return err
+	}
+	var warnings []string
+	if ms != nil {
+		warnings = ms.warnings
 	}
+	commitCc := make(map[string][]*mail.Address)
+	commitMaintainers := make(map[string][]*maintainersSection)
+	for _, commit := range commits {
+		commitCc[commit.Hash] = policy.collect(commit.Author, commit.Message)
 
-	if m.loadingMsg != "" {
-		sb.WriteString(m.spinner.View() + m.loadingMsg + "\n")
-	} else if m.done {
-		sb.WriteString(successStyle.Render("✓ Patches sent\n"))
-	} else {
-		btn := button{
-			Label:    "Submit",
-			Active:   m.state == submitStateConfirm,
-			Disabled: !m.canSubmit(),
+		if ms == nil {
+			continue
+		}
+		sections, err := ms.match(ctx, commit.Hash)
+		if err != nil {
+			return err
+		}
+		commitMaintainers[commit.Hash] = sections
+		if ms.mode == maintainersModePatch {
+			_, people := maintainersRecipients(sections)
+			commitCc[commit.Hash] = policy.appendUnique(commitCc[commit.Hash], people...)
 		}
-		sb.WriteString(btn.View() + "\n")
 	}
 
-	sb.WriteString("\n")
-
-	if len(m.commits) > 0 {
-		sb.WriteString(pluralize("commit", len(m.commits)) + "\n")
-
-		n := len(m.commits)
-		if n > 10 {
-			n = 10
+	// Run sendemail.toCmd and friends on the patches, to show their results
+	cmds, err := loadRecipientCmds(identity)
+	if err != nil {
+		return err
+	}
+	commitCmds := make(map[string]*recipientCmdsResult)
+	if cmds != nil && len(commits) > 0 {
+		options := gitFormatPatchOptions{}
+		if coverCommit != nil {
+			options.CoverCommit = coverCommit.Hash
 		}
-		for _, commit := range m.commits[:n] {
-			hash := commit.Hash[:12]
-			sb.WriteString(hashStyle.Render(hash) + " " + commit.Subject + "\n")
+		patches, err := formatGitPatches(ctx, baseBranch, tip, &options)
+		if err != nil {
+			return err
+		}
+		for _, patch := range patches {
+			res, err := cmds.run(ctx, patch.Bytes(), policy)
+			if err != nil {
+				return err
+			}
+			commitCmds[patch.commit] = res
+			commitCc[patch.commit] = appendAddressUnique(commitCc[patch.commit], res.Cc...)
 		}
-	} else if m.errMsg == "" {
-		sb.WriteString(warningStyle.Render("⚠ There are no changes\n"))
 	}
 
-	if m.errMsg != "" {
-		sb.WriteString(errorStyle.Render("× " + m.errMsg + "\n"))
+	return submissionLog{
+		revRange:             revRange,
+		commits:              commits,
+		coverLetter:          coverLetter,
+		coverCommit:          coverCommit,
+		commitCc:             commitCc,
+		commitMaintainers:    commitMaintainers,
+		commitCmds:           commitCmds,
+		stack:                stack,
+		sameAsPrevSubmission: sameAsPrevSubmission,
+		warnings:             warnings,
 	}
-
-	return lipgloss.NewStyle().Padding(1).Render(sb.String())
 }
 
-func (m submitModel) setState(state submitState) submitModel {
-	m.to.Blur()
-	m.to.PromptStyle = labelStyle
-	m.to.TextStyle = textStyle
-
-	m.version.Blur()
-	m.version.PromptStyle = labelStyle
-	m.version.TextStyle = textStyle
+type mailSender interface {
+	Close() error
+	SendMail(ctx context.Context, from string, to []string, data io.Reader) error
+}
 
-	m.state = state
-	switch state {
-	case submitStateTo:
-		m.to.Focus()
-		m.to.PromptStyle = activeLabelStyle
-		m.to.TextStyle = activeTextStyle
-	case submitStateVersion:
-		m.version.Focus()
-		m.version.PromptStyle = activeLabelStyle
-		m.version.TextStyle = activeTextStyle
+func submitPatches(ctx context.Context, headBranch string, submission *submissionConfig, git *gitSendEmailConfig, coverLetter string, validator *patchValidator, ch chan<- submissionProgress) tea.Msg {
+	ob, err := createSubmissionOutbox(ctx, headBranch, submission, coverLetter, validator)
+	if err != nil {
+		return err
 	}
-	return m
+	return sendOutbox(ctx, ob, git, ch)
 }
 
-func (m submitModel) canSubmit() bool {
-	return len(m.commits) > 0 && checkAddressList(m.to.Value()) && checkVersion(m.version.Value())
+// exportSubmission writes the mails of a submission to a local mailbox instead
+// of sending them. No state is saved. The number of mails is returned.
+func exportSubmission(ctx context.Context, headBranch string, submission *submissionConfig, coverLetter string, path string) (int, error) {
+	state, patches, err := prepareSubmission(ctx, headBranch, submission, coverLetter)
+	if err != nil {
+		return 0, err
+	}
+	return exportPreparedSubmission(ctx, state, patches, path)
 }
 
-func loadSubmissionLog(ctx context.Context, baseBranch, headBranch string) tea.Msg {
-	commits, err := loadGitLog(ctx, baseBranch+".."+headBranch)
+func exportPreparedSubmission(ctx context.Context, state *outboxState, patches []patch, path string) (int, error) {
+	mailbox, err := openMailbox(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	sameAsPrevSubmission := false
-	if len(commits) > 0 {
-		last := getLastSentHash(headBranch)
-		sameAsPrevSubmission = last != "" && last == commits[0].Hash
+	for i, patch := range patches {
+		msg := &state.Messages[i]
+		if err := mailbox.SendMail(ctx, msg.From, msg.To, bytes.NewReader(patch.Bytes())); err != nil {
+			mailbox.Close()
+			return 0, err
+		}
 	}
 
-	return submissionLog{commits: commits, sameAsPrevSubmission: sameAsPrevSubmission}
+	return len(patches), mailbox.Close()
 }
 
-type mailSender interface {
-	Close() error
-	SendMail(ctx context.Context, from string, to []string, data io.Reader) error
+func defaultMboxPath(branch, version string) string {
+	name := strings.ReplaceAll(branch, "/", "-")
+	if name == "" || name == "HEAD" {
+		name = "patches"
+	}
+	if version != "" {
+		name += "-v" + version
+	}
+	return name + ".mbox"
 }
 
-func submitPatches(ctx context.Context, headBranch string, submission *submissionConfig, git *gitSendEmailConfig, coverLetter bool, ch chan<- submissionProgress) tea.Msg {
+// createSubmissionOutbox saves the submission settings and writes the messages
+// to the outbox, ready to be sent. If validator is non-nil, the messages are
+// checked first.
+func createSubmissionOutbox(ctx context.Context, headBranch string, submission *submissionConfig, coverLetter string, validator *patchValidator) (*outbox, error) {
 	if err := saveSubmissionConfig(headBranch, submission); err != nil {
-		return err
+		return nil, err
 	}
-	if err := autosaveSendEmailTo(submission.to); err != nil {
-		return err
+	if err := autosaveSendEmailTo(submission.identity, submission.to); err != nil {
+		return nil, err
 	}
 
-	from, err := loadGitSendEmailFrom()
+	state, patches, err := prepareSubmission(ctx, headBranch, submission, coverLetter)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if validator != nil {
+		if err := validator.validate(ctx, patches); err != nil {
+			return nil, err
+		}
+	}
+
+	return createOutbox(state, patches)
+}
+
+// prepareSubmission formats patches and fills their headers, ready to be sent.
+// No cover letter is sent if coverLetter is empty.
+func prepareSubmission(ctx context.Context, headBranch string, submission *submissionConfig, coverLetter string) (*outboxState, []patch, error) {
+	from, err := loadGitSendEmailFrom(submission.identity)
+	if err != nil {
+		return nil, nil, err
 	}
 	_, fromHostname, _ := strings.Cut(from.Address, "@")
 
-	envelopeSender, err := getGitConfig("sendemail.envelopeSender")
+	envelopeSender, err := getSendEmailConfig(submission.identity, "envelopeSender")
 	if err != nil {
-		return err
+		return nil, nil, err
 	} else if envelopeSender == "" {
 		envelopeSender = from.Address
 	}
 
-	patches, err := formatGitPatches(ctx, submission.baseBranch, &gitFormatPatchOptions{
+	commit, err := getGitCommit(revOrHead(submission.tip))
+	if err != nil {
+		return nil, nil, err
+	}
+	base, err := getGitMergeBase(submission.baseBranch, commit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if submission.coverCommit != "" {
+		// Leave the cover letter commit out of range-diffs
+		base = submission.coverCommit
+	}
+
+	options := gitFormatPatchOptions{
 		RerollCount:   submission.rerollCount,
 		CoverLetter:   coverLetter,
 		SubjectPrefix: submission.subjectPrefix,
-	})
+		CoverCommit:   submission.coverCommit,
+		ChangeID:      submission.changeID,
+	}
+	if prev := submission.rangeDiff; prev != nil {
+		options.PrevBase = prev.Base
+		options.PrevTip = prev.Tip
+	}
+	stack, err := loadSeriesStack(submission.baseBranch)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	stack.setFormatPatchOptions(&options)
+	patches, err := formatGitPatches(ctx, submission.baseBranch, submission.tip, &options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policy, err := loadCcPolicy(submission.identity, from)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// In patch mode, maintainers are only Cc'ed on the patches touching their
+	// files, and on the cover letter
+	var (
+		patchMaintainers  = make(map[string][]*mail.Address)
+		seriesMaintainers []*mail.Address
+	)
+	if ms, err := loadMaintainersSuggestions(); err != nil {
+		return nil, nil, err
+	} else if ms != nil && ms.mode == maintainersModePatch {
+		for _, patch := range patches {
+			if patch.commit == "" {
+				continue
+			}
+			sections, err := ms.match(ctx, patch.commit)
+			if err != nil {
+				return nil, nil, err
+			}
+			_, people := maintainersRecipients(sections)
+			patchMaintainers[patch.commit] = people
+			seriesMaintainers = appendAddressUnique(seriesMaintainers, people...)
+		}
 	}
 
+	cmds, err := loadRecipientCmds(submission.identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := outboxState{
+		Branch:   headBranch,
+		Identity: submission.identity,
+		Base:     base,
+		Commit:   commit,
+		Version:  submission.rerollCount,
+		Messages: make([]outboxMessage, len(patches)),
+	}
 	var firstMsgID string
 	for i := range patches {
 		patch := &patches[i]
+
+		// Commands need to be run on the patch generated by git format-patch
+		var cmdsResult recipientCmdsResult
+		if cmds != nil {
+			res, err := cmds.run(ctx, patch.Bytes(), policy)
+			if err != nil {
+				return nil, nil, err
+			}
+			cmdsResult = *res
+		}
+
+		to := appendAddressUnique(append([]*mail.Address(nil), submission.to...), cmdsResult.To...)
+		cc := append([]*mail.Address(nil), submission.cc...)
+		if coverLetter == "" || i > 0 {
+			author, _ := patch.header.AddressList("From")
+			var authorAddr *mail.Address
+			if len(author) > 0 {
+				authorAddr = author[0]
+			}
+			cc = appendAddressUnique(cc, policy.collect(authorAddr, patchCommitMessage(patch.body))...)
+			cc = policy.appendUnique(cc, patchMaintainers[patch.commit]...)
+		} else {
+			cc = policy.appendUnique(cc, seriesMaintainers...)
+		}
+		cc = appendAddressUnique(cc, cmdsResult.Cc...)
+		var ccHeader []*mail.Address
+		for _, addr := range cc {
+			if !containsAddress(to, addr.Address) {
+				ccHeader = append(ccHeader, addr)
+			}
+		}
+
 		patch.header.SetAddressList("From", []*mail.Address{from})
-		patch.header.SetAddressList("To", submission.to)
+		patch.header.SetAddressList("To", to)
+		if len(ccHeader) > 0 {
+			patch.header.SetAddressList("Cc", ccHeader)
+		}
+		for _, field := range cmdsResult.Header {
+			patch.header.Add(field.Key, field.Value)
+		}
 		if err := patch.header.GenerateMessageIDWithHostname(fromHostname); err != nil {
-			return err
+			return nil, nil, err
+		}
+		msgID, _ := patch.header.MessageID()
+		var refs []string
+		if submission.inReplyTo != "" {
+			refs = append(refs, submission.inReplyTo)
 		}
 		if firstMsgID == "" {
-			firstMsgID, _ = patch.header.MessageID()
+			firstMsgID = msgID
 		} else {
-			patch.header.SetMsgIDList("In-Reply-To", []string{firstMsgID})
+			refs = append(refs, firstMsgID)
+		}
+		if len(refs) > 0 {
+			patch.header.SetMsgIDList("In-Reply-To", refs[len(refs)-1:])
+			patch.header.SetMsgIDList("References", refs)
 		}
-	}
 
-	var toAddrs []string
-	for _, addr := range submission.to {
-		toAddrs = append(toAddrs, addr.Address)
-	}
+		var rcpts []string
+		for _, addr := range append(append([]*mail.Address(nil), to...), ccHeader...) {
+			rcpts = append(rcpts, addr.Address)
+		}
 
-	var sender mailSender
-	if git.SMTP != nil {
-		sender, err = git.SMTP.dialAndAuth(ctx)
-	} else {
-		sender = &sendmailCmd{git.Sendmail}
-	}
-	if err != nil {
-		return err
+		subject, _ := patch.header.Subject()
+		state.Messages[i] = outboxMessage{
+			MessageID: msgID,
+			Subject:   subject,
+			From:      envelopeSender,
+			To:        rcpts,
+		}
 	}
-	defer sender.Close()
-
-	progress := submissionProgress{mailsTotal: len(patches)}
-	ch <- progress
 
-	for _, patch := range patches {
-		r := bytes.NewReader(patch.Bytes())
-		err := sender.SendMail(ctx, envelopeSender, toAddrs, r)
-		if err != nil {
-			return err
-		}
+	return &state, patches, nil
+}
 
-		progress.mailsSent++
-		ch <- progress
+// finishSubmission records a fully sent submission. The b4 tracking data is
+// updated on a best-effort basis: failures are returned as warnings.
+func finishSubmission(state *outboxState) ([]string, error) {
+	if err := saveLastSentHash(state.Branch, state.Commit); err != nil {
+		return nil, err
+	}
+	if len(state.Messages) == 0 {
+		return nil, nil
+	}
+	sent := sentVersion{
+		Version:   state.Version,
+		MessageID: state.Messages[0].MessageID,
+		Base:      state.Base,
+		Tip:       state.Commit,
+	}
+	if err := saveSentVersion(state.Branch, &sent); err != nil {
+		return nil, err
 	}
 
-	if err := saveLastSentHash(headBranch); err != nil {
-		return err
+	if err := recordB4SentVersion(state); err != nil {
+		return []string{fmt.Sprintf("Failed to update b4 tracking data: %v", err)}, nil
+	}
+	if state.Commit == sent.Tip {
+		return nil, nil
 	}
 
-	progress.done = true
-	return progress
+	// The cover letter commit and the commits on top have been rewritten
+	if err := saveLastSentHash(state.Branch, state.Commit); err != nil {
+		return nil, err
+	}
+	rewritten := sent
+	rewritten.Base, rewritten.Tip = state.Base, state.Commit
+	return nil, replaceSentVersion(state.Branch, &sent, &rewritten)
 }
 
-func loadGitSendEmailFrom() (*mail.Address, error) {
-	raw, err := getGitConfig("sendemail.from")
+func loadGitSendEmailFrom(identity string) (*mail.Address, error) {
+	raw, err := getSendEmailConfig(identity, "from")
 	if err != nil {
 		return nil, err
 	} else if raw != "" {
@@ -506,22 +1910,27 @@ func loadGitSendEmailFrom() (*mail.Address, error) {
 	return &mail.Address{Name: name, Address: email}, nil
 }
 
-func loadSubmissionConfig(branch string) (*submissionConfig, error) {
+func loadSubmissionConfig(branch, changeID string) (*submissionConfig, error) {
 	if branch == "" {
 		return &submissionConfig{}, nil
 	}
 
 	var (
-		cfg submissionConfig
-		to  string
+		cfg    submissionConfig
+		to, cc string
 	)
 	entries := map[string]*string{
 		"pyonjiTo":          &to,
+		"pyonjiCc":          &cc,
 		"pyonjiBase":        &cfg.baseBranch,
 		"pyonjiRerollCount": &cfg.rerollCount,
 	}
 	for k, ptr := range entries {
-		v, err := getGitConfig("branch." + branch + "." + k)
+		k, err := seriesConfigKey(branch, changeID, k)
+		if err != nil {
+			return nil, err
+		}
+		v, err := getGitConfig(k)
 		if err != nil {
 			return nil, err
 		}
@@ -529,10 +1938,21 @@ func loadSubmissionConfig(branch string) (*submissionConfig, error) {
 	}
 
 	var err error
+	cfg.changeID = changeID
+	if cfg.changeID == "" {
+		cfg.changeID, err = getBranchChangeID(branch)
+		if err != nil {
+			return nil, err
+		}
+	}
 	cfg.to, err = parseAddressList(to)
 	if err != nil {
 		return nil, fmt.Errorf("invalid branch pyonjiTo: %v", err)
 	}
+	cfg.cc, err = parseAddressList(cc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid branch pyonjiCc: %v", err)
+	}
 
 	return &cfg, nil
 }
@@ -542,13 +1962,26 @@ func saveSubmissionConfig(branch string, cfg *submissionConfig) error {
 		return nil
 	}
 
+	if err := attachSeries(branch, cfg.changeID); err != nil {
+		return err
+	}
+
 	kvs := []struct{ k, v string }{
+		{"pyonjiIdentity", cfg.identity},
 		{"pyonjiTo", formatAddressList(cfg.to)},
-		{"pyonjiBase", cfg.baseBranch},
+		{"pyonjiCc", formatAddressList(cfg.cc)},
 		{"pyonjiRerollCount", cfg.rerollCount},
 	}
+	// Relative revisions such as HEAD~3 are only meaningful for this
+	// submission
+	if isGitRefName(cfg.baseBranch) {
+		kvs = append(kvs, struct{ k, v string }{"pyonjiBase", cfg.baseBranch})
+	}
 	for _, kv := range kvs {
-		k := "branch." + branch + "." + kv.k
+		k, err := seriesConfigKey(branch, "", kv.k)
+		if err != nil {
+			return err
+		}
 		if err := setGitConfig(k, kv.v); err != nil {
 			return err
 		}
@@ -558,31 +1991,20 @@ func saveSubmissionConfig(branch string, cfg *submissionConfig) error {
 }
 
 func loadB4ProjectDefaults(cfg *submissionConfig) error {
-	toplevelDir, err := getGitToplevelDir()
-	if err != nil {
-		return err
-	}
-
-	b4ConfigPath := filepath.Join(toplevelDir, ".b4-config")
-	if _, err := os.Stat(b4ConfigPath); os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return err
-	}
-
-	var to, prefixes string
+	var to, cc, prefixes, baseBranch, sameThread string
 	values := map[string]*string{
-		"send-series-to": &to,
-		"send-prefixes":  &prefixes,
+		"send-series-to":   &to,
+		"send-series-cc":   &cc,
+		"send-prefixes":    &prefixes,
+		"base-branch":      &baseBranch,
+		"send-same-thread": &sameThread,
 	}
 	for k, ptr := range values {
-		k = "b4." + k
-		cmd := exec.Command("git", "config", "--file="+b4ConfigPath, "--default=", k)
-		b, err := cmd.Output()
+		v, err := getB4Config(k)
 		if err != nil {
-			return fmt.Errorf("failed to get b4 config %q: %v", k, err)
+			return err
 		}
-		*ptr = strings.TrimSpace(string(b))
+		*ptr = v
 	}
 
 	if len(cfg.to) == 0 && to != "" {
@@ -592,9 +2014,24 @@ func loadB4ProjectDefaults(cfg *submissionConfig) error {
 			return fmt.Errorf("invalid b4.send-series-to: %v", err)
 		}
 	}
+	if len(cfg.cc) == 0 && cc != "" {
+		var err error
+		cfg.cc, err = parseAddressList(cc)
+		if err != nil {
+			return fmt.Errorf("invalid b4.send-series-cc: %v", err)
+		}
+	}
 	if cfg.subjectPrefix == "" && prefixes != "" && validateSubjectPrefix(prefixes) {
 		cfg.subjectPrefix = "PATCH " + prefixes
 	}
+	if cfg.baseBranch == "" {
+		cfg.baseBranch = baseBranch
+	}
+	// "yes" and "shallow" match what pyonji does by default
+	switch strings.ToLower(sameThread) {
+	case "no", "false", "off", "0":
+		cfg.noInReplyToPrev = true
+	}
 
 	return nil
 }
@@ -611,8 +2048,8 @@ func validateSubjectPrefix(s string) bool {
 	return true
 }
 
-func autosaveSendEmailTo(to []*mail.Address) error {
-	cur, err := loadGitSendEmailTo()
+func autosaveSendEmailTo(identity string, to []*mail.Address) error {
+	cur, err := loadGitSendEmailTo(identity)
 	if err != nil {
 		return err
 	} else if len(cur) != 0 {
@@ -629,7 +2066,11 @@ func autosaveSendEmailTo(to []*mail.Address) error {
 		return fmt.Errorf("failed to check for MAINTAINERS: %v", err)
 	}
 
-	return setGitConfig("sendemail.to", formatAddressList(to))
+	k := "sendemail.to"
+	if identity != "" {
+		k = "sendemail." + identity + ".to"
+	}
+	return setGitConfig(k, formatAddressList(to))
 }
 
 func loadGitBranchDescription(branch string) (string, error) {
@@ -639,35 +2080,152 @@ func loadGitBranchDescription(branch string) (string, error) {
 	return getGitConfig("branch." + branch + ".description")
 }
 
-func getLastSentHash(branch string) string {
+func saveGitBranchDescription(branch, desc string) error {
+	if branch == "" {
+		return nil
+	}
+	return setGitConfig("branch."+branch+".description", normalizeBranchDescription(desc))
+}
+
+// normalizeBranchDescription strips surrounding whitespace, like git branch
+// --edit-description.
+func normalizeBranchDescription(desc string) string {
+	desc = strings.TrimSpace(desc)
+	if desc != "" {
+		desc += "\n"
+	}
+	return desc
+}
+
+func getLastSentHash(branch, changeID string) string {
 	if branch == "" {
 		return ""
 	}
-	commit, _ := getGitConfig("branch." + branch + ".pyonjiLastSentHash")
+	k, err := seriesConfigKey(branch, changeID, "pyonjiLastSentHash")
+	if err != nil {
+		return ""
+	}
+	commit, _ := getGitConfig(k)
 	return commit
 }
 
-func saveLastSentHash(branch string) error {
+func saveLastSentHash(branch, commit string) error {
 	if branch == "" {
 		return nil
 	}
 
-	commit, err := getGitCurrentCommit()
+	k, err := seriesConfigKey(branch, "", "pyonjiLastSentHash")
 	if err != nil {
 		return err
 	}
-
-	k := "branch." + branch + ".pyonjiLastSentHash"
 	return setGitConfig(k, commit)
 }
 
-func getNextRerollCount(branch, rerollCount string) (string, error) {
-	last := getLastSentHash(branch)
+// sentVersion describes a version of a patch series which has been sent.
+type sentVersion struct {
+	Version   string
+	MessageID string // of the first message
+	Base, Tip string // commits, may be empty for old entries
+
+	// The commits have been garbage-collected, checked once when loading
+	gone bool
+}
+
+func loadSentVersions(branch, changeID string) ([]sentVersion, error) {
+	if branch == "" {
+		return nil, nil
+	}
+
+	k, err := seriesConfigKey(branch, changeID, "pyonjiSentVersion")
+	if err != nil {
+		return nil, err
+	}
+	values, err := getAllGitConfig(k)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []sentVersion
+	for _, v := range values {
+		fields := strings.Fields(v)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid branch pyonjiSentVersion: %q", v)
+		}
+		sv := sentVersion{Version: fields[0], MessageID: fields[1]}
+		if len(fields) >= 4 {
+			sv.Base, sv.Tip = fields[2], fields[3]
+			sv.gone = !checkGitCommit(sv.Tip)
+		}
+		l = append(l, sv)
+	}
+	return l, nil
+}
+
+func saveSentVersion(branch string, v *sentVersion) error {
+	if branch == "" {
+		return nil
+	}
+
+	k, err := seriesConfigKey(branch, "", "pyonjiSentVersion")
+	if err != nil {
+		return err
+	}
+	return addGitConfig(k, formatSentVersion(v))
+}
+
+// replaceSentVersion updates a sent version, e.g. after its commits have been
+// rewritten.
+func replaceSentVersion(branch string, old, v *sentVersion) error {
+	if branch == "" {
+		return nil
+	}
+
+	k, err := seriesConfigKey(branch, "", "pyonjiSentVersion")
+	if err != nil {
+		return err
+	}
+	return replaceGitConfig(k, formatSentVersion(v), "^"+regexp.QuoteMeta(formatSentVersion(old))+"$")
+}
+
+func formatSentVersion(v *sentVersion) string {
+	version := v.Version
+	if version == "" {
+		version = "1"
+	}
+	return strings.Join([]string{version, v.MessageID, v.Base, v.Tip}, " ")
+}
+
+// findPrevVersion returns the latest sent version preceding the specified one.
+func findPrevVersion(versions []sentVersion, version string) *sentVersion {
+	cur, err := strconv.Atoi(version)
+	if err != nil {
+		cur = 1
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := &versions[i]
+		if n, err := strconv.Atoi(v.Version); err == nil && n < cur {
+			return v
+		}
+	}
+	return nil
+}
+
+// canRangeDiff checks whether a range-diff against the previous version can be
+// included in a submission.
+func canRangeDiff(prev *sentVersion, numCommits int, coverLetter bool) bool {
+	if prev == nil || prev.Tip == "" || prev.gone {
+		return false
+	}
+	return numCommits == 1 || coverLetter
+}
+
+func getNextRerollCount(branch, changeID, tip, rerollCount string) (string, error) {
+	last := getLastSentHash(branch, changeID)
 	if last == "" {
 		return rerollCount, nil
 	}
 
-	if cur, err := getGitCurrentCommit(); err != nil {
+	if cur, err := getGitCommit(revOrHead(tip)); err != nil {
 		return "", err
 	} else if cur == last {
 		return rerollCount, nil
@@ -741,6 +2299,13 @@ func (f *formField) View() string {
 	return fmt.Sprintf("%v %v", labelStyle.Render(f.Label), textStyle.Render(f.Text))
 }
 
+func checkbox(checked bool) string {
+	if checked {
+		return "[x]"
+	}
+	return "[ ]"
+}
+
 type button struct {
 	Label            string
 	Active, Disabled bool
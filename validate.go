@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// patchValidator runs the checks configured for the repository before
+// patches are sent: the sendemail-validate hook on each patch, and
+// pyonji.validateSeriesCmd on the whole series.
+type patchValidator struct {
+	Hook      string
+	SeriesCmd string
+}
+
+type validationFailure struct {
+	Name   string `json:"name"` // patch subject, or "series"
+	Output string `json:"output"`
+}
+
+type validationError struct {
+	failures []validationFailure
+}
+
+func (err *validationError) Error() string {
+	var names []string
+	for _, failure := range err.failures {
+		names = append(names, failure.Name)
+	}
+	return fmt.Sprintf("validation failed: %v", strings.Join(names, ", "))
+}
+
+// loadPatchValidator returns nil if there is nothing to check, or if
+// sendemail.validate is disabled.
+func loadPatchValidator() (*patchValidator, error) {
+	enabled, err := getGitConfigBool("sendemail.validate", true)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	var v patchValidator
+	v.SeriesCmd, err = getGitConfig("pyonji.validateSeriesCmd")
+	if err != nil {
+		return nil, err
+	}
+
+	// core.hooksPath is taken into account by --git-path
+	cmd := exec.Command("git", "rev-parse", "--path-format=absolute", "--git-path", "hooks/sendemail-validate")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Git hooks directory: %v", err)
+	}
+	hook := strings.TrimSpace(string(out))
+	if fi, err := os.Stat(hook); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0 {
+		v.Hook = hook
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to check sendemail-validate hook: %v", err)
+	}
+
+	if v.Hook == "" && v.SeriesCmd == "" {
+		return nil, nil
+	}
+	return &v, nil
+}
+
+// validate runs the checks on the patches. Like git-send-email, each patch is
+// written to a file passed to the hook, which is run from the top-level
+// directory. Failures are returned as a *validationError.
+func (v *patchValidator) validate(ctx context.Context, patches []patch) error {
+	toplevelDir, err := getGitToplevelDir()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "pyonji-validate-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filenames := make([]string, len(patches))
+	for i, patch := range patches {
+		filenames[i] = filepath.Join(dir, fmt.Sprintf("%04d.patch", i))
+		if err := os.WriteFile(filenames[i], patch.Bytes(), 0600); err != nil {
+			return fmt.Errorf("failed to write patch file: %v", err)
+		}
+	}
+
+	var failures []validationFailure
+	run := func(name string, cmd *exec.Cmd) error {
+		cmd.Dir = toplevelDir
+		out, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			failures = append(failures, validationFailure{Name: name, Output: strings.TrimSpace(string(out))})
+		} else if err != nil {
+			return fmt.Errorf("failed to run %v check: %v", name, err)
+		}
+		return nil
+	}
+
+	if v.Hook != "" {
+		for i, filename := range filenames {
+			cmd := exec.CommandContext(ctx, v.Hook, filename)
+			cmd.Env = append(os.Environ(),
+				"GIT_SENDEMAIL_FILE_COUNTER="+strconv.Itoa(i+1),
+				"GIT_SENDEMAIL_FILE_TOTAL="+strconv.Itoa(len(filenames)))
+			subject, _ := patches[i].header.Subject()
+			if err := run(subject, cmd); err != nil {
+				return err
+			}
+		}
+	}
+
+	if v.SeriesCmd != "" {
+		args := append([]string{"-c", v.SeriesCmd + ` "$@"`, "-"}, filenames...)
+		if err := run("series", exec.CommandContext(ctx, "sh", args...)); err != nil {
+			return err
+		}
+	}
+
+	if len(failures) > 0 {
+		return &validationError{failures}
+	}
+	return nil
+}